@@ -0,0 +1,202 @@
+package redmon
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ntons/redis"
+)
+
+// 批量操作的单键结果
+type Result struct {
+	Rev int64
+	Val string
+	// ErrNotExists/ErrRevMismatch等单键错误
+	Err error
+	// 哈希数据标记，由Store.LoadMany返回，Val为字段到值的msgpack map
+	Hash bool
+}
+
+// 批量获取数据，所有脚本调用在一次往返中完成
+// 不在缓存里的数据按(database, collection)分组批量从DB加载，之后只重试这些数据
+func (cli *Client) MGet(ctx context.Context, keys []string, opts ...GetOption) (a []Result, err error) {
+	var xopts xGetOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	args := xopts.args()
+	a = make([]Result, len(keys))
+	err = cli.runMany(ctx, "redmon_get", keys, xopts.ttl,
+		func(int) []any { return args },
+		func(i int, r *redis.Cmd) {
+			a[i].Rev, a[i].Val, a[i].Err = getRes(r)
+		},
+	)
+	return
+}
+
+// 批量设置数据，keys与vals一一对应，所有脚本调用在一次往返中完成
+// 不在缓存里的数据按(database, collection)分组批量从DB加载，之后只重试这些数据
+// keys与vals长度不一致时返回ErrLengthMismatch
+func (cli *Client) MSet(ctx context.Context, keys, vals []string, opts ...SetOption) (a []Result, err error) {
+	if len(keys) != len(vals) {
+		return nil, ErrLengthMismatch
+	}
+	var xopts xSetOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	a = make([]Result, len(keys))
+	err = cli.runMany(ctx, "redmon_set", keys, 0,
+		func(i int) []any { return xopts.args(vals[i]) },
+		func(i int, r *redis.Cmd) {
+			a[i].Rev, a[i].Err = setRes(r)
+		},
+	)
+	return
+}
+
+// 批量推送的单键结果
+type PushResult struct {
+	Id int64
+	// 被淘汰的邮件
+	Evicted []*Mail
+	// ErrMailBoxFull等单键错误
+	Err error
+}
+
+// 向多个邮箱推送相同的邮件，所有脚本调用在一次往返中完成
+// 不在缓存里的邮箱批量从DB加载，之后只重试这些邮箱
+// 被淘汰的邮件保存在PushResult.Evicted中，同时通过OnMailEvict回调
+func (cli *Client) PushMany(ctx context.Context, keys []string, val string, opts ...PushOption) (a []PushResult, err error) {
+	var xopts xPushOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	args := cli.mbArgs(xopts.args(val)...)
+	a = make([]PushResult, len(keys))
+	err = cli.runMany(ctx, "redmon_mb_push", keys, 0,
+		func(int) []any { return args },
+		func(i int, r *redis.Cmd) {
+			a[i].Id, a[i].Evicted, a[i].Err = pushRes(r)
+		},
+	)
+	for i := range a {
+		cli.onMailEvict(keys[i], a[i].Evicted)
+	}
+	return
+}
+
+// 对每个键执行脚本，未加载的数据批量加载后重试，加载的数据以ttl过期
+// f处理每个键的脚本返回，只有Redis或Mongo整体失败时才返回错误
+func (cli *Client) runMany(
+	ctx context.Context, cmd string, keys []string, ttl time.Duration,
+	args func(i int) []any, f func(i int, r *redis.Cmd)) (err error) {
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	for retried := false; len(idx) > 0; retried = true {
+		var cmds []*redis.Cmd
+		if cmds, err = cli.pipeline(ctx, cmd, len(idx),
+			func(j int) string { return keys[idx[j]] },
+			func(j int) []any { return args(idx[j]) },
+		); err != nil {
+			return
+		}
+		var missed []int
+		for j, r := range cmds {
+			if r.Err() == redis.Nil && !retried {
+				missed = append(missed, idx[j])
+			} else {
+				f(idx[j], r)
+			}
+		}
+		if len(missed) > 0 {
+			a := make([]string, 0, len(missed))
+			for _, i := range missed {
+				a = append(a, keys[i])
+			}
+			if err = cli.loadMany(ctx, a, ttl); err != nil {
+				return
+			}
+		}
+		idx = missed
+	}
+	return
+}
+
+// 在一次往返中执行n次脚本，脚本未加载时加载后重新执行
+// 单个脚本的错误保存在对应的Cmd中
+func (cli *Client) pipeline(
+	ctx context.Context, cmd string, n int,
+	key func(i int) string, args func(i int) []any) (cmds []*redis.Cmd, err error) {
+	for loaded := false; ; loaded = true {
+		pipe := cli.rdb.Pipeline()
+		cmds = make([]*redis.Cmd, n)
+		for i := 0; i < n; i++ {
+			cmds[i] = luaScript.Run(
+				ctx, pipe, []string{key(i)},
+				append([]any{cmd}, args(i)...)...)
+		}
+		// script errors are checked one by one by caller
+		if _, err = pipe.Exec(ctx); err != nil {
+			if _, ok := err.(interface{ RedisError() }); !ok {
+				return
+			}
+			err = nil
+		}
+		noScript := false
+		for _, r := range cmds {
+			if r.Err() != nil && strings.HasPrefix(r.Err().Error(), "NOSCRIPT ") {
+				noScript = true
+				break
+			}
+		}
+		if !noScript || loaded {
+			return
+		}
+		if err = cli.rdb.ScriptLoad(ctx, luaScript.Src()).Err(); err != nil {
+			return
+		}
+	}
+}
+
+// Load data from database to cache in batch
+func (cli *Client) loadMany(ctx context.Context, keys []string, ttl time.Duration) (err error) {
+	bufs := make(map[string]string)
+	uniq := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := bufs[key]; !ok {
+			bufs[key] = ""
+			uniq = append(uniq, key)
+		}
+	}
+	res, err := cli.store.LoadMany(ctx, uniq)
+	if err != nil {
+		return
+	}
+	for i, key := range uniq {
+		if bufs[key], err = pack(res[i]); err != nil {
+			return
+		}
+	}
+	a := make([]string, 0, len(bufs))
+	for key := range bufs {
+		a = append(a, key)
+	}
+	cmds, err := cli.pipeline(ctx, "redmon_load", len(a),
+		func(i int) string { return a[i] },
+		func(i int) []any { return append([]any{bufs[a[i]]}, cli.ttlArgs(a[i], ttl)...) },
+	)
+	if err != nil {
+		return
+	}
+	for _, r := range cmds {
+		if err = r.Err(); err != nil {
+			return
+		}
+	}
+	return
+}
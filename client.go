@@ -3,13 +3,11 @@ package redmon
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/ntons/redis"
 	"github.com/vmihailenco/msgpack/v4"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // REDIS存储数据对象(cmsgpack不接受bin数据类型，只能用string)
@@ -20,18 +18,43 @@ type xRedisData struct {
 	Rev int64 `msgpack:"rev" bson:"rev" json:"rev"`
 	// 数据有效载荷
 	Val string `msgpack:"val" bson:"val" json:"val"`
+	// 删除标记(墓碑)，删除同样递增修订以保证回写顺序
+	Del bool `msgpack:"del,omitempty" bson:"del" json:"del,omitempty"`
+	// 回写后的过期时长(秒)，由SetOption指定，之后的任何写入都会清除，不回写到DB
+	Ex int64 `msgpack:"ex,omitempty" bson:"-" json:"-"`
+	// 哈希数据标记，Val为字段到值的msgpack map
+	Hsh bool `msgpack:"hsh,omitempty" bson:"-" json:"-"`
+	// 上次回写后修改的哈希字段，回写时只需写入这些字段
+	Hch []string `msgpack:"hch,omitempty" bson:"-" json:"-"`
+	// 哈希数据需要整体回写
+	Hfull bool `msgpack:"hfull,omitempty" bson:"-" json:"-"`
 }
 
-// MONGO存储数据对象
-type xMongoData struct {
-	Rev int64  `msgpack:"rev" bson:"rev" json:"rev"`
-	Val []byte `msgpack:"val" bson:"val" json:"val"`
+// 将存储加载结果转换为REDIS存储数据，不存在时以墓碑保留修订
+func pack(r Result) (_ string, err error) {
+	data := &xRedisData{Rev: r.Rev, Val: r.Val, Hsh: r.Hash}
+	if r.Err == ErrNotExists {
+		data.Del, data.Hsh = r.Rev > 0, false
+	} else if r.Err != nil {
+		return "", r.Err
+	}
+	buf, err := msgpack.Marshal(data)
+	if err != nil {
+		return
+	}
+	return b2s(buf), nil
 }
 
 // 邮箱
 type xMailBox struct {
-	Seq int64   `msgpack:"seq"` // id generater
-	Que []*Mail `msgpack:"que"` // queue, ordered by id
+	Seq int64   `msgpack:"seq"` // seq generater
+	Que []*Mail `msgpack:"que"` // queue, ordered by (importance, seq)
+	// last id generated by MailIdTime layout
+	Tid int64 `msgpack:"tid,omitempty"`
+	// broadcast channel -> highest seq below which all mails are materialized
+	Cur map[string]int64 `msgpack:"cur,omitempty"`
+	// broadcast channel -> materialized seqs above Cur
+	Dlv map[string][]int64 `msgpack:"dlv,omitempty"`
 }
 
 // 邮件
@@ -40,34 +63,77 @@ type Mail struct {
 	Id int64 `msgpack:"id"`
 	// mail payload
 	Val string `msgpack:"val"`
+	// expire at unix milliseconds, 0 for never
+	ExpireAt int64 `msgpack:"exp,omitempty"`
+	// visible at unix milliseconds, 0 for immediately
+	VisibleAt int64 `msgpack:"vis,omitempty"`
+	// idempotency key, unique in mailbox
+	DedupKey string `msgpack:"dup,omitempty"`
+	// broadcast channel of mail not materialized yet, only set by List
+	Channel string `msgpack:"chn,omitempty"`
+	// state flags, MailRead/MailClaimed or user defined
+	Flags uint32 `msgpack:"flg,omitempty"`
+	// importance, higher is more important
+	Importance uint8 `msgpack:"imp"`
+	// push seq in mailbox, starts from 1
+	Seq int64 `msgpack:"seq"`
 }
 
-func (m Mail) GetImportance() uint8 { return uint8(m.Id / 1e10) }
+// 邮件状态标记，其他位可由使用者自定义
+const (
+	MailRead uint32 = 1 << iota
+	MailClaimed
+)
+
+// 邮件ID格式，只影响新邮件，邮箱中已有的邮件保持原ID
+// 邮件总是按(重要度，序号)排列，与ID格式无关
+type MailIdLayout int
+
+const (
+	// 重要度*1e10+序号，默认格式，每个重要度最多1e10封邮件
+	MailIdImportance MailIdLayout = iota
+	// 序号
+	MailIdSeq
+	// 毫秒时间*1000+毫秒内序号，单调递增
+	MailIdTime
+)
+
+// 旧版邮件没有重要度字段，从ID解析
+func (m Mail) GetImportance() uint8 {
+	if m.Seq == 0 {
+		return uint8(m.Id / 1e10)
+	}
+	return m.Importance
+}
+
+func (m Mail) HasFlags(flags uint32) bool { return m.Flags&flags == flags }
 
 // 客户端
 type Client struct {
 	*xOptions
-	// redis/mongo clients
+	// redis client
 	rdb redis.Client
-	mdb *mongo.Client
+	// 持久化存储
+	store Store
 }
 
-func NewClient(rdb redis.Client, mdb *mongo.Client, opts ...Option) *Client {
+func NewClient(rdb redis.Client, store Store, opts ...Option) *Client {
 	o := &xOptions{}
 	for _, opt := range opts {
 		opt.apply(o)
 	}
-	return &Client{xOptions: o, rdb: rdb, mdb: mdb}
+	return &Client{xOptions: o, rdb: rdb, store: store}
 }
 
 // 获取数据，如果指定数据不在缓存里会自动从DB加载
+// 数据不存在时返回ErrNotExists，同时返回当前修订(被删除的数据修订不为0)
 func (cli *Client) Get(ctx context.Context, key string, opts ...GetOption) (rev int64, val string, err error) {
 	var xopts xGetOptions
 	for _, opt := range opts {
 		opt.apply(&xopts)
 	}
 	if rev, val, err = cli.rget(ctx, key, xopts); err == redis.Nil {
-		if err = cli.load(ctx, key); err != nil {
+		if err = cli.load(ctx, key, xopts.ttl); err != nil {
 			return
 		}
 		rev, val, err = cli.rget(ctx, key, xopts)
@@ -77,11 +143,11 @@ func (cli *Client) Get(ctx context.Context, key string, opts ...GetOption) (rev
 
 // 获取缓存数据
 func (cli *Client) rget(ctx context.Context, key string, opts xGetOptions) (_ int64, _ string, err error) {
-	var args []any
-	if opts.addIfNotExists != nil {
-		args = append(args, *opts.addIfNotExists)
-	}
-	s, err := cli.run(ctx, "redmon_get", key, args...).Text()
+	return getRes(cli.run(ctx, "redmon_get", key, opts.args()...))
+}
+
+func getRes(r *redis.Cmd) (_ int64, _ string, err error) {
+	s, err := r.Text()
 	if err != nil {
 		return
 	}
@@ -89,34 +155,109 @@ func (cli *Client) rget(ctx context.Context, key string, opts xGetOptions) (_ in
 	if err = msgpack.Unmarshal(s2b(s), &data); err != nil {
 		return
 	}
-	if data.Rev == 0 {
-		return 0, "", ErrNotExists
+	if data.Rev == 0 || data.Del {
+		return data.Rev, "", ErrNotExists
 	}
 	return data.Rev, data.Val, nil
 }
 
 // 设置数据，如果指定数据不在缓存里会自动从DB加载
 // 缓存中的脏数据由Sync异步回写到DB
-func (cli *Client) Set(ctx context.Context, key, val string) (rev int64, err error) {
-	if rev, err = cli.rset(ctx, key, val); err == redis.Nil {
-		if err = cli.load(ctx, key); err != nil {
+// 指定IfRev时修订不匹配返回ErrRevMismatch，同时返回当前修订
+func (cli *Client) Set(ctx context.Context, key, val string, opts ...SetOption) (rev int64, err error) {
+	var xopts xSetOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if rev, err = cli.rset(ctx, key, val, xopts); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
 			return
 		}
-		rev, err = cli.rset(ctx, key, val)
+		rev, err = cli.rset(ctx, key, val, xopts)
 	}
 	return
 }
 
+// 比较并设置数据，仅当当前修订等于rev时修改，等价于Set(ctx, key, val, IfRev(rev))
+func (cli *Client) CompareAndSet(ctx context.Context, key string, rev int64, val string) (int64, error) {
+	return cli.Set(ctx, key, val, IfRev(rev))
+}
+
+// 读取-修改-写入回调函数，exists为false时rev为当前修订(可能是删除墓碑)
+type UpdateFunc func(rev int64, val string, exists bool) (string, error)
+
+// Update默认的最大重试次数和最大重试间隔
+const (
+	defaultUpdateRetries = 10
+	defaultUpdateBackoff = 100 * time.Millisecond
+)
+
+// 原子地更新数据，循环执行Get+CompareAndSet直到成功、重试次数用尽或ctx结束
+// 返回新的修订和因修订冲突而重试的次数，重试次数用尽时返回ErrRevMismatch
+// 重试前按指数退避随机等待，避免竞争激烈时空转
+func (cli *Client) Update(ctx context.Context, key string, f UpdateFunc, opts ...UpdateOption) (rev int64, retries int, err error) {
+	var xopts xUpdateOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if xopts.maxRetries == 0 {
+		xopts.maxRetries = defaultUpdateRetries
+	}
+	if xopts.maxBackoff <= 0 {
+		xopts.maxBackoff = defaultUpdateBackoff
+	}
+	backoff := time.Millisecond
+	for ; ; retries++ {
+		var val string
+		var exists bool
+		if rev, val, err = cli.Get(ctx, key); err == nil {
+			exists = true
+		} else if err != ErrNotExists {
+			return
+		}
+		if val, err = f(rev, val, exists); err != nil {
+			return
+		}
+		if rev, err = cli.Set(ctx, key, val, IfRev(rev)); err != ErrRevMismatch {
+			return
+		}
+		if xopts.maxRetries > 0 && retries >= xopts.maxRetries {
+			return
+		}
+		if backoff > xopts.maxBackoff {
+			backoff = xopts.maxBackoff
+		}
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return rev, retries, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
 // 设置缓存数据
-func (cli *Client) rset(ctx context.Context, key, val string) (rev int64, err error) {
-	return cli.run(ctx, "redmon_set", key, val).Int64()
+func (cli *Client) rset(ctx context.Context, key, val string, opts xSetOptions) (rev int64, err error) {
+	return setRes(cli.run(ctx, "redmon_set", key, opts.args(val)...))
+}
+
+func setRes(r *redis.Cmd) (rev int64, err error) {
+	if rev, err = r.Int64(); err != nil {
+		return
+	}
+	if rev < 0 {
+		return -1 - rev, ErrRevMismatch
+	}
+	return
 }
 
 // 新增数据，如果指定数据不在缓存里会自动从DB加载
 // 如果指定数据已存在返回ErrAlreadyExists
 func (cli *Client) Add(ctx context.Context, key, val string) (err error) {
 	if err = cli.radd(ctx, key, val); err == redis.Nil {
-		if err = cli.load(ctx, key); err != nil {
+		if err = cli.load(ctx, key, 0); err != nil {
 			return
 		}
 		err = cli.radd(ctx, key, val)
@@ -134,42 +275,340 @@ func (cli *Client) radd(ctx context.Context, key, val string) error {
 	return nil
 }
 
+// 删除数据，如果指定数据不在缓存里会自动从DB加载
+// 如果指定数据不存在返回ErrNotExists
+func (cli *Client) Delete(ctx context.Context, key string) (err error) {
+	if err = cli.rdel(ctx, key); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		err = cli.rdel(ctx, key)
+	}
+	return
+}
+
+// 删除缓存数据
+func (cli *Client) rdel(ctx context.Context, key string) error {
+	if r, err := cli.run(ctx, "redmon_del", key).Int64(); err != nil {
+		return err
+	} else if r == 0 {
+		return ErrNotExists
+	}
+	return nil
+}
+
+// 计数加1，等价于IncrBy(ctx, key, 1, opts...)
+func (cli *Client) Incr(ctx context.Context, key string, opts ...IncrOption) (val, rev int64, err error) {
+	return cli.IncrBy(ctx, key, 1, opts...)
+}
+
+// 计数减1，等价于IncrBy(ctx, key, -1, opts...)
+func (cli *Client) Decr(ctx context.Context, key string, opts ...IncrOption) (val, rev int64, err error) {
+	return cli.IncrBy(ctx, key, -1, opts...)
+}
+
+// 原子地增加计数，如果指定数据不在缓存里会自动从DB加载
+// 数据为十进制整数，不存在时视为0，返回新值和新修订，由Sync回写
+// 数据不是整数时返回ErrNotNumber，新值越界时返回ErrOutOfRange，同时返回当前值和当前修订
+func (cli *Client) IncrBy(ctx context.Context, key string, delta int64, opts ...IncrOption) (val, rev int64, err error) {
+	var xopts xIncrOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if val, rev, err = cli.rincr(ctx, key, delta, xopts); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		val, rev, err = cli.rincr(ctx, key, delta, xopts)
+	}
+	return
+}
+
+// 增加缓存计数
+func (cli *Client) rincr(ctx context.Context, key string, delta int64, opts xIncrOptions) (val, rev int64, err error) {
+	a, err := cli.run(ctx, "redmon_incr", key, opts.args(delta)...).Int64Slice()
+	if err != nil {
+		return
+	}
+	switch val, rev = a[1], a[2]; a[0] {
+	case 0:
+		err = ErrOutOfRange
+	case -1:
+		err = ErrNotNumber
+	}
+	return
+}
+
+// 获取哈希字段，如果指定数据不在缓存里会自动从DB加载
+// 数据或字段不存在时返回ErrNotExists，数据不是哈希时返回ErrNotHash
+func (cli *Client) HGet(ctx context.Context, key, field string) (rev int64, val string, err error) {
+	if rev, val, err = cli.rhget(ctx, key, field); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		rev, val, err = cli.rhget(ctx, key, field)
+	}
+	return
+}
+
+// 获取缓存哈希字段
+func (cli *Client) rhget(ctx context.Context, key, field string) (rev int64, val string, err error) {
+	v, err := cli.run(ctx, "redmon_hget", key, field).Result()
+	if err != nil {
+		return
+	}
+	if err = hashRes(v); err != nil {
+		return
+	}
+	a := v.([]interface{})
+	if rev = a[0].(int64); len(a) < 2 {
+		return rev, "", ErrNotExists
+	}
+	return rev, a[1].(string), nil
+}
+
+// 获取全部哈希字段，如果指定数据不在缓存里会自动从DB加载
+// 数据不存在时返回ErrNotExists，数据不是哈希时返回ErrNotHash
+func (cli *Client) HGetAll(ctx context.Context, key string) (rev int64, fields map[string]string, err error) {
+	if rev, fields, err = cli.rhgetall(ctx, key); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		rev, fields, err = cli.rhgetall(ctx, key)
+	}
+	return
+}
+
+// 获取缓存全部哈希字段
+func (cli *Client) rhgetall(ctx context.Context, key string) (rev int64, fields map[string]string, err error) {
+	v, err := cli.run(ctx, "redmon_hgetall", key).Result()
+	if err != nil {
+		return
+	}
+	if err = hashRes(v); err != nil {
+		return
+	}
+	a := v.([]interface{})
+	if fields, err = decodeHash(a[1].(string)); err != nil {
+		return
+	}
+	return a[0].(int64), fields, nil
+}
+
+// 设置哈希字段，如果指定数据不在缓存里会自动从DB加载
+// 数据不存在时创建哈希数据，数据不是哈希时返回ErrNotHash
+// Sync只回写上次回写以来修改的字段(如果存储支持)
+func (cli *Client) HSet(ctx context.Context, key string, fields map[string]string) (rev int64, err error) {
+	args := make([]any, 0, len(fields)*2)
+	for f, v := range fields {
+		args = append(args, f, v)
+	}
+	if rev, err = cli.rhset(ctx, key, args); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		rev, err = cli.rhset(ctx, key, args)
+	}
+	return
+}
+
+// 设置缓存哈希字段
+func (cli *Client) rhset(ctx context.Context, key string, args []any) (rev int64, err error) {
+	if rev, err = cli.run(ctx, "redmon_hset", key, args...).Int64(); err == nil && rev < 0 {
+		err = ErrNotHash
+	}
+	return
+}
+
+// 删除哈希字段，如果指定数据不在缓存里会自动从DB加载
+// 返回被删除的字段数量，删除全部字段后保留空哈希，数据不是哈希时返回ErrNotHash
+func (cli *Client) HDel(ctx context.Context, key string, fields ...string) (n int, err error) {
+	args := make([]any, len(fields))
+	for i, f := range fields {
+		args[i] = f
+	}
+	if n, err = cli.rhdel(ctx, key, args); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		n, err = cli.rhdel(ctx, key, args)
+	}
+	return
+}
+
+// 删除缓存哈希字段
+func (cli *Client) rhdel(ctx context.Context, key string, args []any) (n int, err error) {
+	if n, err = cli.run(ctx, "redmon_hdel", key, args...).Int(); err == nil && n < 0 {
+		n, err = 0, ErrNotHash
+	}
+	return
+}
+
+// redmon_hget/redmon_hgetall返回0数据不存在，-1不是哈希数据
+func hashRes(v interface{}) error {
+	switch v {
+	case int64(0):
+		return ErrNotExists
+	case int64(-1):
+		return ErrNotHash
+	}
+	return nil
+}
+
 // 获取邮箱数据，如果指定数据不在缓存里会自动从DB加载
-func (cli *Client) List(ctx context.Context, key string) (_ []*Mail, err error) {
-	_, val, err := cli.Get(ctx, key)
+// 可以指定分页和过滤条件，只有匹配的邮件会从缓存返回，邮件按(重要度，序号)排列
+// 指定WithBroadcast时，广播频道中尚未接收的邮件只在第一页(没有WithOffset、WithAfter和WithAfterMail)返回，
+// 追加在邮箱邮件之后，不受WithLimit限制，只按重要度和标记过滤，Mail.Channel为其所属频道，Mail.Id为其在频道中的ID
+// 翻页时应使用最后一封Mail.Channel为空的邮件作为游标
+// 非默认ID格式下指定WithAfter返回ErrBadCursor
+func (cli *Client) List(ctx context.Context, key string, opts ...ListOption) (list []*Mail, err error) {
+	var xopts xListOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if err = xopts.check(cli.mailIdLayout); err != nil {
+		return
+	}
+	keys := append([]string{key}, xopts.channels...)
+	if list, err = cli.rlist(ctx, keys, xopts); err == redis.Nil {
+		if err = cli.loadMany(ctx, keys, 0); err != nil {
+			return
+		}
+		list, err = cli.rlist(ctx, keys, xopts)
+	}
+	return
+}
+
+// 统计匹配的邮件数量而不返回邮件，如果指定数据不在缓存里会自动从DB加载
+// 过滤条件同List，忽略WithOffset和WithLimit，如未读数量: WithoutFlags(MailRead)
+func (cli *Client) Count(ctx context.Context, key string, opts ...ListOption) (n int, err error) {
+	var xopts xListOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if err = xopts.check(cli.mailIdLayout); err != nil {
+		return
+	}
+	keys := append([]string{key}, xopts.channels...)
+	if n, err = cli.rcount(ctx, keys, xopts); err == redis.Nil {
+		if err = cli.loadMany(ctx, keys, 0); err != nil {
+			return
+		}
+		n, err = cli.rcount(ctx, keys, xopts)
+	}
+	return
+}
+
+// 统计缓存邮件
+func (cli *Client) rcount(ctx context.Context, keys []string, opts xListOptions) (n int, err error) {
+	v, err := cli.runKeys(ctx, "redmon_mb_list", keys, append(opts.args(), "1")...).Result()
 	if err != nil {
 		return
 	}
-	var data xMailBox
-	if err = msgpack.Unmarshal(s2b(val), &data); err != nil {
+	a, ok := v.([]interface{})
+	if !ok {
+		return 0, ErrNotExists
+	}
+	return int(a[0].(int64)), nil
+}
+
+// 设置邮件标记，如果指定数据不在缓存里会自动从DB加载
+// 返回被标记的邮件ID(其他的ID不存在)
+func (cli *Client) Mark(ctx context.Context, key string, ids []int64, flags uint32) (marked []int64, err error) {
+	return cli.mark(ctx, key, ids, flags, 0)
+}
+
+// 清除邮件标记，如果指定数据不在缓存里会自动从DB加载
+// 返回被清除标记的邮件ID(其他的ID不存在)
+func (cli *Client) Unmark(ctx context.Context, key string, ids []int64, flags uint32) (marked []int64, err error) {
+	return cli.mark(ctx, key, ids, 0, flags)
+}
+
+func (cli *Client) mark(ctx context.Context, key string, ids []int64, set, clr uint32) (marked []int64, err error) {
+	if len(ids) == 0 {
 		return
 	}
-	return data.Que, nil
+	if marked, err = cli.rmark(ctx, key, ids, set, clr); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
+			return
+		}
+		marked, err = cli.rmark(ctx, key, ids, set, clr)
+	}
+	return
+}
+
+// 标记缓存邮件
+func (cli *Client) rmark(ctx context.Context, key string, ids []int64, set, clr uint32) (marked []int64, err error) {
+	args := make([]any, 0, 2+len(ids))
+	args = append(args, set, clr)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	r, err := cli.run(ctx, "redmon_mb_mark", key, cli.mbArgs(args...)...).Result()
+	if err != nil {
+		return
+	}
+	for _, v := range r.([]interface{}) {
+		marked = append(marked, v.(int64))
+	}
+	return
+}
+
+// 查看缓存邮件，过滤和分页在脚本中完成
+func (cli *Client) rlist(ctx context.Context, keys []string, opts xListOptions) (list []*Mail, err error) {
+	v, err := cli.runKeys(ctx, "redmon_mb_list", keys, opts.args()...).Result()
+	if err != nil {
+		return
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, ErrNotExists
+	}
+	if err = msgpack.Unmarshal(s2b(s), &list); err != nil {
+		return
+	}
+	return
 }
 
 // 添加邮件，如果指定数据不在缓存里会自动从DB加载
+// 过期的邮件在邮箱被修改时清除，未到可见时间的邮件不会被List和Pop返回
+// 指定WithDedupKey时，邮箱中已有相同去重键的邮件则返回其ID，不再重复添加
+// 邮箱满时按WithEviction指定的策略淘汰邮件，被淘汰的邮件通过OnMailEvict回调
 func (cli *Client) Push(ctx context.Context, key, val string, opts ...PushOption) (id int64, err error) {
 	var xopts xPushOptions
 	for _, opt := range opts {
 		opt.apply(&xopts)
 	}
-	if id, err = cli.rpush(ctx, key, val, xopts); err == redis.Nil {
-		if err = cli.load(ctx, key); err != nil {
+	var evicted []*Mail
+	if id, evicted, err = cli.rpush(ctx, key, val, xopts); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
 			return
 		}
-		id, err = cli.rpush(ctx, key, val, xopts)
+		id, evicted, err = cli.rpush(ctx, key, val, xopts)
 	}
+	cli.onMailEvict(key, evicted)
 	return
 }
 
 // 添加缓存邮件
-func (cli *Client) rpush(ctx context.Context, key, val string, opts xPushOptions) (id int64, err error) {
-	var args = []any{val, opts.importance, opts.capacity, opts.strategy}
-	if id, err = cli.run(ctx, "redmon_mb_push", key, args...).Int64(); err != nil {
+func (cli *Client) rpush(ctx context.Context, key, val string, opts xPushOptions) (id int64, evicted []*Mail, err error) {
+	return pushRes(cli.run(ctx, "redmon_mb_push", key, cli.mbArgs(opts.args(val)...)...))
+}
+
+func pushRes(r *redis.Cmd) (id int64, evicted []*Mail, err error) {
+	v, err := r.Result()
+	if err != nil {
 		return
 	}
-	if id == -1 {
-		return 0, ErrMailBoxFull
+	a, ok := v.([]interface{})
+	if !ok || len(a) == 0 {
+		panic(fmt.Errorf("unexpected return type: %T", v))
+	}
+	if id = a[0].(int64); id == -1 {
+		return 0, nil, ErrMailBoxFull
+	}
+	if err = msgpack.Unmarshal(s2b(a[1].(string)), &evicted); err != nil {
+		return
 	}
 	return
 }
@@ -180,7 +619,7 @@ func (cli *Client) Pull(ctx context.Context, key string, ids ...int64) (pulled [
 		return
 	}
 	if pulled, err = cli.rpull(ctx, key, ids...); err == redis.Nil {
-		if err = cli.load(ctx, key); err != nil {
+		if err = cli.load(ctx, key, 0); err != nil {
 			return
 		}
 		pulled, err = cli.rpull(ctx, key, ids...)
@@ -194,7 +633,7 @@ func (cli *Client) rpull(ctx context.Context, key string, ids ...int64) (pulled
 	for _, id := range ids {
 		args = append(args, id)
 	}
-	r, err := cli.run(ctx, "redmon_mb_pull", key, args...).Result()
+	r, err := cli.run(ctx, "redmon_mb_pull", key, cli.mbArgs(args...)...).Result()
 	if err != nil {
 		return
 	}
@@ -204,107 +643,91 @@ func (cli *Client) rpull(ctx context.Context, key string, ids ...int64) (pulled
 	return
 }
 
-// run script and deal errors and stats
-func (cli *Client) run(ctx context.Context, cmd string, key string, args ...any) (r *redis.Cmd) {
-	return luaScript.Run(ctx, cli.rdb, []string{key}, append([]any{cmd}, args...)...)
-}
-
-// Load data from database to cache
-// Cache only be updated when not exists or the loaded data is newer
-func (cli *Client) load(ctx context.Context, key string) (err error) {
-	database, collection, _id := cli.mapKey(key)
-	var data xMongoData
-	if err = cli.mdb.Database(database).Collection(collection).FindOne(
-		ctx, bson.M{"_id": _id}).Decode(&data); err != nil {
-		if err != mongo.ErrNoDocuments {
+// 原子地取出并删除至多n封邮件，如果指定数据不在缓存里会自动从DB加载
+// 默认重要度最高的优先，指定WithLowest时重要度最低的优先，重要度相同时先进先出
+func (cli *Client) Pop(ctx context.Context, key string, n int, opts ...PopOption) (popped []*Mail, err error) {
+	if n <= 0 {
+		return
+	}
+	var xopts xPopOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if popped, err = cli.rpop(ctx, key, n, xopts); err == redis.Nil {
+		if err = cli.load(ctx, key, 0); err != nil {
 			return
 		}
-		err = nil
+		popped, err = cli.rpop(ctx, key, n, xopts)
 	}
-	var buf []byte
-	if buf, err = msgpack.Marshal(&xRedisData{
-		Rev: data.Rev,
-		Val: b2s(data.Val),
-	}); err != nil {
+	return
+}
+
+// 取出缓存邮件
+func (cli *Client) rpop(ctx context.Context, key string, n int, opts xPopOptions) (popped []*Mail, err error) {
+	s, err := cli.run(ctx, "redmon_mb_pop", key, cli.mbArgs(opts.args(n)...)...).Text()
+	if err != nil {
 		return
 	}
-	if err = cli.run(ctx, "redmon_load", key, b2s(buf)).Err(); err != nil {
+	if err = msgpack.Unmarshal(s2b(s), &popped); err != nil {
 		return
 	}
 	return
 }
 
-// //////////////////////////////////////////////////////////////////////////////
-// Syncing
-// //////////////////////////////////////////////////////////////////////////////
-func (cli *Client) Sync(ctx context.Context) {
-	var backoff *time.Timer
-	for {
-		for key, data, err := cli.peek(ctx); ; key, data, err = cli.next(ctx, key, data.Rev) {
-			if err == nil {
-				err = cli.save(ctx, key, data)
-			}
-			var d time.Duration
-			if err == nil {
-				d = cli.onSyncSave(key)
-			} else if err == redis.Nil {
-				d = cli.onSyncIdle()
-			} else {
-				d = cli.onSyncFail(err)
-			}
-			if d > 0 {
-				if backoff == nil {
-					backoff = time.NewTimer(d)
-					defer backoff.Stop()
-				} else {
-					backoff.Reset(d)
-				}
-				select {
-				case <-ctx.Done():
-					return
-				case <-backoff.C:
-				}
-			}
-			if err != nil {
-				break
-			}
+// 接收广播邮件，如果指定数据不在缓存里会自动从DB加载
+// 原子地把广播频道中尚未接收的邮件复制到邮箱，保留重要度、重新分配ID，并推进邮箱在各频道的游标
+// 广播邮件按推送顺序接收，已过期的邮件被跳过，未到可见时间的邮件留待以后接收，不影响其后邮件的接收
+// 返回复制到邮箱的邮件ID
+func (cli *Client) Materialize(ctx context.Context, key string, channels ...string) (ids []int64, err error) {
+	if len(channels) == 0 {
+		return
+	}
+	keys := append([]string{key}, channels...)
+	if ids, err = cli.rmaterialize(ctx, keys); err == redis.Nil {
+		if err = cli.loadMany(ctx, keys, 0); err != nil {
+			return
 		}
+		ids, err = cli.rmaterialize(ctx, keys)
+	}
+	return
+}
+
+// 接收缓存广播邮件
+func (cli *Client) rmaterialize(ctx context.Context, keys []string) (ids []int64, err error) {
+	r, err := cli.runKeys(ctx, "redmon_mb_materialize", keys, cli.mbArgs()...).Result()
+	if err != nil {
+		return
+	}
+	for _, v := range r.([]interface{}) {
+		ids = append(ids, v.(int64))
 	}
+	return
 }
 
-// peek top dirty key and data
-func (cli *Client) peek(ctx context.Context) (string, xRedisData, error) {
-	return cli.getSyncRes(luaScript.Run(ctx, cli.rdb, []string{}, "redmon_sync"))
+// run script and deal errors and stats
+func (cli *Client) run(ctx context.Context, cmd string, key string, args ...any) (r *redis.Cmd) {
+	return cli.runKeys(ctx, cmd, []string{key}, args...)
 }
 
-// clean dirty flag and make key volatile, then peek the next
-func (cli *Client) next(ctx context.Context, key string, rev int64) (string, xRedisData, error) {
-	return cli.getSyncRes(luaScript.Run(ctx, cli.rdb, []string{key}, "redmon_sync", rev))
+// run script on multiple keys, the first one is the major key
+func (cli *Client) runKeys(ctx context.Context, cmd string, keys []string, args ...any) (r *redis.Cmd) {
+	return luaScript.Run(ctx, cli.rdb, keys, append([]any{cmd}, args...)...)
 }
 
-func (*Client) getSyncRes(r *redis.Cmd) (key string, data xRedisData, err error) {
-	var v interface{}
-	if v, err = r.Result(); err != nil {
+// Load data from database to cache
+// Cache only be updated when not exists or the loaded data is newer
+// Loaded data expires after ttl, or the configured ttl of key if ttl is 0
+func (cli *Client) load(ctx context.Context, key string, ttl time.Duration) (err error) {
+	res, err := cli.store.Load(ctx, key)
+	if err != nil {
 		return
-	} else if a, ok := v.([]interface{}); !ok || len(a) != 2 {
-		panic(fmt.Errorf("unexpected return type: %T", r))
-	} else if err = msgpack.Unmarshal(s2b(a[1].(string)), &data); err != nil {
+	}
+	var b string
+	if b, err = pack(res); err != nil {
 		return
-	} else {
-		return a[0].(string), data, nil
-	}
-}
-
-func (cli *Client) save(ctx context.Context, key string, data xRedisData) (err error) {
-	database, collection, _id := cli.mapKey(key)
-	_, err = cli.mdb.Database(database).Collection(collection).UpdateOne(
-		ctx,
-		bson.M{"_id": _id},
-		bson.M{"$set": &xMongoData{
-			Rev: data.Rev,
-			Val: s2b(data.Val),
-		}},
-		options.Update().SetUpsert(true),
-	)
+	}
+	if err = cli.run(ctx, "redmon_load", key, append([]any{b}, cli.ttlArgs(key, ttl)...)...).Err(); err != nil {
+		return
+	}
 	return
 }
@@ -2,14 +2,18 @@ package redmon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ntons/redis"
+	"github.com/ntons/redmon/redmontest"
 	"github.com/vmihailenco/msgpack/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -28,13 +32,28 @@ func rSetData(ctx context.Context, r redis.Client, key string, d xRedisData) {
 	r.Set(ctx, key, b2s(b), 0)
 }
 
-func dial(t *testing.T) (redis.Client, *mongo.Client) {
+// 默认使用内存REDIS和内存存储，设置REDMON_TEST_LIVE时连接本地REDIS和MONGO
+func dial(t *testing.T) (redis.Client, Store) {
+	if os.Getenv("REDMON_TEST_LIVE") == "" {
+		r, _ := redmontest.NewRedis(t)
+		return r, NewMemStore()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	r, err := redis.Dial(ctx, "redis://127.0.0.1:6379")
 	if err != nil {
 		t.Fatal("failed to new redis client:", err)
 	}
+	return r, NewMongoStore(dialMongo(t), nil)
+}
+
+// 只在设置REDMON_TEST_LIVE时连接本地MONGO，否则跳过测试
+func dialMongo(t *testing.T) *mongo.Client {
+	if os.Getenv("REDMON_TEST_LIVE") == "" {
+		t.Skip("REDMON_TEST_LIVE not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 	m, err := mongo.NewClient(
 		mongooptions.Client().ApplyURI("mongodb://127.0.0.1"))
 	if err != nil {
@@ -43,12 +62,12 @@ func dial(t *testing.T) (redis.Client, *mongo.Client) {
 	if err := m.Connect(ctx); err != nil {
 		t.Fatal("failed to connect mongo server:", err)
 	}
-	return r, m
+	return m
 }
 
 func TestGet(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -89,8 +108,8 @@ func TestGet(t *testing.T) {
 }
 
 func TestSet(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -99,14 +118,14 @@ func TestSet(t *testing.T) {
 	defer r.Del(ctx, key)
 
 	r.Del(ctx, key)
-	if _, err := cli.rset(ctx, key, val); err != redis.Nil {
+	if _, err := cli.rset(ctx, key, val, xSetOptions{}); err != redis.Nil {
 		t.Fatalf("unexpected set err: %v", err)
 	}
 
 	var d = xRedisData{Rev: 0}
 	b, _ := msgpack.Marshal(&d)
 	r.Set(ctx, key, b2s(b), 0)
-	if _, err := cli.rset(ctx, key, val); err != nil {
+	if _, err := cli.rset(ctx, key, val, xSetOptions{}); err != nil {
 		t.Fatalf("unexpected set err: %v", err)
 	}
 	b, _ = r.Get(ctx, key).Bytes()
@@ -118,7 +137,7 @@ func TestSet(t *testing.T) {
 		t.Fatalf("unexpected set val: %v", d.Val)
 	}
 
-	if _, err := cli.rset(ctx, key, val); err != nil {
+	if _, err := cli.rset(ctx, key, val, xSetOptions{}); err != nil {
 		t.Fatalf("unexpected set err: %v", err)
 	}
 	b, _ = r.Get(ctx, key).Bytes()
@@ -131,9 +150,95 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestCompareAndSet(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = "hello", "world"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+	if _, err := cli.rset(ctx, key, val, xSetOptions{ifRev: new(int64)}); err != redis.Nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+
+	rSetData(ctx, r, key, xRedisData{Rev: 0})
+	if rev, err := cli.CompareAndSet(ctx, key, 0, val); err != nil {
+		t.Fatalf("unexpected cas err: %v", err)
+	} else if rev != 1 {
+		t.Fatalf("unexpected cas rev: %v", rev)
+	}
+	if rev, err := cli.CompareAndSet(ctx, key, 0, "other"); err != ErrRevMismatch {
+		t.Fatalf("unexpected cas err: %v", err)
+	} else if rev != 1 {
+		t.Fatalf("unexpected cas rev: %v", rev)
+	}
+	if d := rGetData(ctx, r, key); d.Rev != 1 || d.Val != val {
+		t.Fatalf("unexpected cas data: %v", d)
+	}
+	if rev, err := cli.Set(ctx, key, "other", IfRev(1)); err != nil {
+		t.Fatalf("unexpected cas err: %v", err)
+	} else if rev != 2 {
+		t.Fatalf("unexpected cas rev: %v", rev)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key = "hello"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+	rSetData(ctx, r, key, xRedisData{Rev: 0})
+
+	// the first attempt races with another writer
+	var calls int
+	f := func(rev int64, val string, exists bool) (string, error) {
+		if calls++; calls == 1 {
+			if exists || rev != 0 {
+				t.Fatalf("unexpected update arg: %v, %v", rev, exists)
+			}
+			cli.rset(ctx, key, "a", xSetOptions{})
+		}
+		return val + "b", nil
+	}
+	if rev, retries, err := cli.Update(ctx, key, f); err != nil {
+		t.Fatalf("unexpected update err: %v", err)
+	} else if rev != 2 || retries != 1 {
+		t.Fatalf("unexpected update ret: %v, %v", rev, retries)
+	}
+	if d := rGetData(ctx, r, key); d.Rev != 2 || d.Val != "ab" {
+		t.Fatalf("unexpected update data: %v", d)
+	}
+
+	// always losing exhausts the retry budget
+	f = func(rev int64, val string, exists bool) (string, error) {
+		cli.rset(ctx, key, val, xSetOptions{})
+		return val, nil
+	}
+	if _, retries, err := cli.Update(ctx, key, f, WithMaxRetries(3)); err != ErrRevMismatch {
+		t.Fatalf("unexpected update err: %v", err)
+	} else if retries != 3 {
+		t.Fatalf("unexpected update retries: %v", retries)
+	}
+	if _, retries, err := cli.Update(ctx, key, f, WithMaxBackoff(time.Millisecond)); err != ErrRevMismatch {
+		t.Fatalf("unexpected update err: %v", err)
+	} else if retries != defaultUpdateRetries {
+		t.Fatalf("unexpected update retries: %v", retries)
+	}
+}
+
 func TestAdd(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -157,9 +262,216 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = "hello", "world"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+	if err := cli.rdel(ctx, key); err != redis.Nil {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+
+	rSetData(ctx, r, key, xRedisData{Rev: 0})
+	if err := cli.rdel(ctx, key); err != ErrNotExists {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+
+	rSetData(ctx, r, key, xRedisData{Rev: 1, Val: val})
+	if err := cli.rdel(ctx, key); err != nil {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+	if d := rGetData(ctx, r, key); d.Rev != 2 || !d.Del || d.Val != "" {
+		t.Fatalf("unexpected delete data: %v", d)
+	}
+	if _, _, err := cli.rget(ctx, key, xGetOptions{}); err != ErrNotExists {
+		t.Fatalf("unexpected get err: %v", err)
+	}
+	if err := cli.rdel(ctx, key); err != ErrNotExists {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+
+	if err := cli.radd(ctx, key, val); err != nil {
+		t.Fatalf("unexpected add err: %v", err)
+	}
+	if d := rGetData(ctx, r, key); d.Rev != 3 || d.Del || d.Val != val {
+		t.Fatalf("unexpected add data: %v", d)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key = fmt.Sprintf("%d", rand.Int())
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	if val, rev, err := cli.IncrBy(ctx, key, 10); err != nil {
+		t.Fatalf("unexpected incr err: %v", err)
+	} else if val != 10 || rev != 1 {
+		t.Fatalf("unexpected incr: %v, %v", val, rev)
+	}
+	if val, rev, err := cli.Decr(ctx, key, WithMin(0)); err != nil {
+		t.Fatalf("unexpected decr err: %v", err)
+	} else if val != 9 || rev != 2 {
+		t.Fatalf("unexpected decr: %v, %v", val, rev)
+	}
+	if val, rev, err := cli.IncrBy(ctx, key, -10, WithMin(0)); err != ErrOutOfRange {
+		t.Fatalf("unexpected incr err: %v", err)
+	} else if val != 9 || rev != 2 {
+		t.Fatalf("unexpected incr: %v, %v", val, rev)
+	}
+	if _, _, err := cli.Incr(ctx, key, WithMax(9)); err != ErrOutOfRange {
+		t.Fatalf("unexpected incr err: %v", err)
+	}
+	if val, _, err := cli.IncrBy(ctx, key, 1<<40, WithMin(0), WithMax(1<<41)); err != nil {
+		t.Fatalf("unexpected incr err: %v", err)
+	} else if val != 1<<40+9 {
+		t.Fatalf("unexpected incr: %v", val)
+	}
+	if _, val, err := cli.Get(ctx, key); err != nil {
+		t.Fatalf("unexpected get err: %v", err)
+	} else if val != fmt.Sprintf("%d", int64(1<<40+9)) {
+		t.Fatalf("unexpected get: %v", val)
+	}
+
+	// persisted like any other dirty key
+	if _, failed, err := cli.Flush(ctx, key); err != nil || len(failed) > 0 {
+		t.Fatalf("unexpected flush err: %v, %v", err, failed)
+	}
+	if _, val, err := storeLoad(ctx, s, key); err != nil {
+		t.Fatalf("unexpected load err: %v", err)
+	} else if val != fmt.Sprintf("%d", int64(1<<40+9)) {
+		t.Fatalf("unexpected load: %v", val)
+	}
+
+	if _, err := cli.Set(ctx, key, "hello"); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	if _, _, err := cli.Incr(ctx, key); err != ErrNotNumber {
+		t.Fatalf("unexpected incr err: %v", err)
+	}
+}
+
+// records entries saved by Sync
+type testEntryStore struct {
+	*MemStore
+	entries []Entry
+}
+
+func (s *testEntryStore) SaveMany(ctx context.Context, entries []Entry) []error {
+	s.entries = append(s.entries, entries...)
+	return s.MemStore.SaveMany(ctx, entries)
+}
+
+func TestHash(t *testing.T) {
+	r, _ := dial(t)
+	s := &testEntryStore{MemStore: NewMemStore()}
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key = fmt.Sprintf("%d", rand.Int())
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	if _, _, err := cli.HGetAll(ctx, key); err != ErrNotExists {
+		t.Fatalf("unexpected hgetall err: %v", err)
+	}
+	if rev, err := cli.HSet(ctx, key, map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("unexpected hset err: %v", err)
+	} else if rev != 1 {
+		t.Fatalf("unexpected hset rev: %v", rev)
+	}
+	if rev, val, err := cli.HGet(ctx, key, "a"); err != nil {
+		t.Fatalf("unexpected hget err: %v", err)
+	} else if rev != 1 || val != "1" {
+		t.Fatalf("unexpected hget: %v, %v", rev, val)
+	}
+	if _, _, err := cli.HGet(ctx, key, "c"); err != ErrNotExists {
+		t.Fatalf("unexpected hget err: %v", err)
+	}
+
+	// created hash is saved as a whole
+	if _, failed, err := cli.Flush(ctx, key); err != nil || len(failed) > 0 {
+		t.Fatalf("unexpected flush err: %v, %v", err, failed)
+	}
+	if len(s.entries) != 1 || !s.entries[0].Hash || s.entries[0].Fields != nil {
+		t.Fatalf("unexpected saved entries: %v", s.entries)
+	}
+
+	// reloaded from store, then only changed fields are saved
+	r.Del(ctx, key)
+	if _, err := cli.HSet(ctx, key, map[string]string{"c": "3"}); err != nil {
+		t.Fatalf("unexpected hset err: %v", err)
+	}
+	if n, err := cli.HDel(ctx, key, "a", "x"); err != nil {
+		t.Fatalf("unexpected hdel err: %v", err)
+	} else if n != 1 {
+		t.Fatalf("unexpected hdel: %v", n)
+	}
+	if rev, fields, err := cli.HGetAll(ctx, key); err != nil {
+		t.Fatalf("unexpected hgetall err: %v", err)
+	} else if rev != 3 || !reflect.DeepEqual(fields, map[string]string{"b": "2", "c": "3"}) {
+		t.Fatalf("unexpected hgetall: %v, %v", rev, fields)
+	}
+	if _, failed, err := cli.Flush(ctx, key); err != nil || len(failed) > 0 {
+		t.Fatalf("unexpected flush err: %v, %v", err, failed)
+	}
+	if e := s.entries[len(s.entries)-1]; e.Rev != 3 || !e.Hash || !reflect.DeepEqual(e.Fields, []string{"c", "a"}) {
+		t.Fatalf("unexpected saved entry: %v", e)
+	}
+	// changed fields are cleared after synced
+	if _, err := cli.HSet(ctx, key, map[string]string{"b": "4"}); err != nil {
+		t.Fatalf("unexpected hset err: %v", err)
+	}
+	if _, failed, err := cli.Flush(ctx, key); err != nil || len(failed) > 0 {
+		t.Fatalf("unexpected flush err: %v, %v", err, failed)
+	}
+	if e := s.entries[len(s.entries)-1]; e.Rev != 4 || !reflect.DeepEqual(e.Fields, []string{"b"}) {
+		t.Fatalf("unexpected saved entry: %v", e)
+	}
+
+	if n, err := cli.HDel(ctx, key, "b", "c"); err != nil || n != 2 {
+		t.Fatalf("unexpected hdel: %v, %v", n, err)
+	}
+	if _, fields, err := cli.HGetAll(ctx, key); err != nil || len(fields) != 0 {
+		t.Fatalf("unexpected hgetall: %v, %v", fields, err)
+	}
+	if _, _, err := cli.Incr(ctx, key); err != ErrNotNumber {
+		t.Fatalf("unexpected incr err: %v", err)
+	}
+
+	// overwritten by Set, no longer a hash
+	if _, err := cli.Set(ctx, key, "hello"); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	if _, err := cli.HSet(ctx, key, map[string]string{"a": "1"}); err != ErrNotHash {
+		t.Fatalf("unexpected hset err: %v", err)
+	}
+	if _, _, err := cli.HGet(ctx, key, "a"); err != ErrNotHash {
+		t.Fatalf("unexpected hget err: %v", err)
+	}
+	if _, err := cli.HDel(ctx, key, "a"); err != ErrNotHash {
+		t.Fatalf("unexpected hdel err: %v", err)
+	}
+}
+
 func TestLoad(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -173,9 +485,7 @@ func TestLoad(t *testing.T) {
 	)
 
 	r.Del(ctx, key)
-	m.Database(database).Collection(collection).DeleteOne(
-		ctx, bson.M{"_id": _id})
-	if err := cli.load(ctx, key); err != nil {
+	if err := cli.load(ctx, key, 0); err != nil {
 		t.Fatalf("unexpected load err: %v", err)
 	}
 	if d := rGetData(ctx, r, key); d.Rev != 0 {
@@ -183,10 +493,11 @@ func TestLoad(t *testing.T) {
 	}
 
 	r.Del(ctx, key)
-	m.Database(database).Collection(collection).InsertOne(
-		ctx, bson.M{"_id": _id, "rev": 1, "val": []byte(val)})
+	if err := s.Save(ctx, key, 1, val); err != nil {
+		t.Fatalf("unexpected save err: %v", err)
+	}
 
-	if err := cli.load(ctx, key); err != nil {
+	if err := cli.load(ctx, key, 0); err != nil {
 		t.Fatalf("unexpected load err: %v", err)
 	}
 	if d := rGetData(ctx, r, key); d.Rev != 1 {
@@ -196,9 +507,127 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestLoadMany(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		database   = "test"
+		collection = "redmon"
+		keys       []string
+		ids        []string
+	)
+	for i := 0; i < 3; i++ {
+		_id := fmt.Sprintf("%d", rand.Int())
+		ids = append(ids, _id)
+		keys = append(keys, fmt.Sprintf("%s:%s:%s", database, collection, _id))
+	}
+	defer r.Del(ctx, keys...)
+
+	r.Del(ctx, keys...)
+	if err := s.Save(ctx, keys[1], 1, "hello"); err != nil {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+	if err := cli.loadMany(ctx, keys, 0); err != nil {
+		t.Fatalf("unexpected load err: %v", err)
+	}
+	for i, key := range keys {
+		if d := rGetData(ctx, r, key); i == 1 && (d.Rev != 1 || d.Val != "hello") {
+			t.Fatalf("unexpected load data: %v", d)
+		} else if i != 1 && d.Rev != 0 {
+			t.Fatalf("unexpected load data: %v", d)
+		}
+	}
+}
+
+func TestMGetMSet(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var keys = []string{"hello1", "hello2", "hello3"}
+	defer r.Del(ctx, keys...)
+
+	r.Del(ctx, keys...)
+	for _, key := range keys {
+		rSetData(ctx, r, key, xRedisData{Rev: 0})
+	}
+
+	if _, err := cli.MSet(ctx, keys, []string{"a"}); err != ErrLengthMismatch {
+		t.Fatalf("unexpected mset err: %v", err)
+	}
+	if a, err := cli.MSet(ctx, keys[:2], []string{"a", "b"}); err != nil {
+		t.Fatalf("unexpected mset err: %v", err)
+	} else if len(a) != 2 || a[0].Rev != 1 || a[1].Rev != 1 {
+		t.Fatalf("unexpected mset ret: %v", a)
+	}
+	if a, err := cli.MSet(ctx, keys[1:], []string{"c", "d"}, IfRev(0)); err != nil {
+		t.Fatalf("unexpected mset err: %v", err)
+	} else if a[0].Err != ErrRevMismatch || a[0].Rev != 1 {
+		t.Fatalf("unexpected mset ret: %v", a[0])
+	} else if a[1].Err != nil || a[1].Rev != 1 {
+		t.Fatalf("unexpected mset ret: %v", a[1])
+	}
+
+	if a, err := cli.MGet(ctx, append(keys, keys[0])); err != nil {
+		t.Fatalf("unexpected mget err: %v", err)
+	} else if len(a) != 4 {
+		t.Fatalf("unexpected mget len: %v", len(a))
+	} else {
+		for i, v := range []string{"a", "b", "d", "a"} {
+			if a[i].Err != nil || a[i].Rev != 1 || a[i].Val != v {
+				t.Fatalf("unexpected mget ret: %v", a[i])
+			}
+		}
+	}
+}
+
+func TestPushMany(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var keys []string
+	for i := 0; i < 3; i++ {
+		keys = append(keys, fmt.Sprintf("%d", rand.Int()))
+	}
+	defer r.Del(ctx, keys...)
+
+	r.Del(ctx, keys...)
+	rSetData(ctx, r, keys[0], xRedisData{Rev: 0})
+	if _, err := cli.Push(ctx, keys[2], "hello"); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+
+	// keys[1] is loaded, keys[2] is full
+	if a, err := cli.PushMany(ctx, keys, "world", WithCapacity(1)); err != nil {
+		t.Fatalf("unexpected push many err: %v", err)
+	} else if len(a) != 3 {
+		t.Fatalf("unexpected push many len: %v", len(a))
+	} else if a[0].Err != nil || a[0].Id != 1 || a[1].Err != nil || a[1].Id != 1 {
+		t.Fatalf("unexpected push many ret: %v", a)
+	} else if a[2].Err != ErrMailBoxFull {
+		t.Fatalf("unexpected push many ret: %v", a[2])
+	}
+	for _, key := range keys[:2] {
+		if list, err := cli.List(ctx, key); err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		} else if len(list) != 1 || list[0].Val != "world" {
+			t.Fatalf("unexpected list: %v", list)
+		}
+	}
+}
+
 func TestMail(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -285,8 +714,8 @@ func TestMail(t *testing.T) {
 }
 
 func TestMail2(t *testing.T) {
-	r, m := dial(t)
-	cli := NewClient(r, m)
+	r, s := dial(t)
+	cli := NewClient(r, s)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -315,52 +744,1074 @@ func TestMail2(t *testing.T) {
 			}
 		}
 	}
+
+	// pagination and filtering
+	for _, c := range []struct {
+		opts  []ListOption
+		first int64
+		n     int
+	}{
+		{[]ListOption{WithMinImportance(5)}, 5, 5},
+		{[]ListOption{WithOffset(2), WithLimit(3)}, 2, 3},
+		{[]ListOption{WithAfter(6*1e10 + 7)}, 7, 3},
+		{[]ListOption{WithMinImportance(3), WithAfter(5*1e10 + 6), WithLimit(2)}, 6, 2},
+		{[]ListOption{WithOffset(10)}, 0, 0},
+	} {
+		if list, err := cli.List(ctx, key, c.opts...); err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		} else if len(list) != c.n {
+			t.Fatalf("unexpected list len: %v", len(list))
+		} else {
+			for i, m := range list {
+				if id := c.first + int64(i); m.Id != id*1e10+id+1 {
+					t.Fatalf("unexpected list elem: %v", m)
+				}
+			}
+		}
+	}
 }
 
-func TestSync(t *testing.T) {
-	const (
-		xDirtySet = "$DIRTYSET$"
-		xDirtyQue = "$DIRTYQUE$"
-	)
-	r, m := dial(t)
-	cli := NewClient(r, m)
+func TestMailIdLayout(t *testing.T) {
+	r, s := dial(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
-	r.Del(ctx, xDirtyQue, xDirtySet, key)
+	var key = fmt.Sprintf("%d", rand.Int())
+	defer r.Del(ctx, key)
 
-	if _, _, err := cli.peek(ctx); err != redis.Nil {
-		t.Fatalf("unexpected peek error: %v", err)
+	// legacy mailbox without importance and seq fields
+	b, _ := msgpack.Marshal(map[string]any{
+		"seq": 2,
+		"que": []map[string]any{
+			{"id": 2, "val": "b"},
+			{"id": 3*1e10 + 1, "val": "a"},
+		},
+	})
+	rSetData(ctx, r, key, xRedisData{Rev: 1, Val: b2s(b)})
+
+	cli := NewClient(r, s, WithMailIdLayout(MailIdSeq))
+	if list, err := cli.List(ctx, key, WithMinImportance(3)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 1 || list[0].Val != "a" || list[0].GetImportance() != 3 || list[0].Seq != 1 {
+		t.Fatalf("unexpected list: %v", list)
 	}
 
-	b, _ := msgpack.Marshal(&xRedisData{Rev: 1, Val: val})
-	r.Set(ctx, key, b2s(b), 0)
-	r.SAdd(ctx, xDirtySet, key)
-	r.LPush(ctx, xDirtyQue, key)
+	if id, err := cli.Push(ctx, key, "c", WithImportance(1)); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	} else if id != 3 {
+		t.Fatalf("unexpected push id: %v", id)
+	}
 
-	if k, d, err := cli.peek(ctx); err != nil {
-		t.Fatalf("unexpected peek error: %v", err)
-	} else if k != key {
-		t.Fatalf("unexpected peek key: %v", k)
-	} else if d.Rev != 1 {
-		t.Fatalf("unexpected peek rev: %v", d.Rev)
-	} else if d.Val != val {
-		t.Fatalf("unexpected peek val: %v", d.Val)
+	cli = NewClient(r, s, WithMailIdLayout(MailIdTime))
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		if id, err := cli.Push(ctx, key, "d", WithImportance(2)); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		} else if (i > 0 && id <= ids[i-1]) || id/1000 > time.Now().UnixMilli() {
+			t.Fatalf("unexpected push id: %v", id)
+		} else {
+			ids = append(ids, id)
+		}
 	}
 
-	if k, d, err := cli.next(ctx, key, 2); err != nil {
-		t.Fatalf("unexpected next error: %v", err)
-	} else if k != key {
-		t.Fatalf("unexpected next key: %v", k)
-	} else if d.Rev != 1 {
-		t.Fatalf("unexpected next rev: %v", d.Rev)
-	} else if d.Val != val {
-		t.Fatalf("unexpected next val: %v", d.Val)
+	// ordered by (importance, seq) whatever the id layout
+	if list, err := cli.List(ctx, key); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 6 {
+		t.Fatalf("unexpected list len: %v", len(list))
+	} else {
+		for i, v := range "bcddda" {
+			if list[i].Val != string(v) {
+				t.Fatalf("unexpected list elem: %v", list[i])
+			}
+		}
 	}
 
-	if _, _, err := cli.next(ctx, key, 1); err != redis.Nil {
-		t.Fatalf("unexpected next error: %v", err)
+	// cursor follows list order
+	if _, err := cli.List(ctx, key, WithAfter(3)); err != ErrBadCursor {
+		t.Fatalf("unexpected list err: %v", err)
+	}
+	var list []*Mail
+	for {
+		opts := []ListOption{WithLimit(1)}
+		if len(list) > 0 {
+			opts = append(opts, WithAfterMail(list[len(list)-1]))
+		}
+		a, err := cli.List(ctx, key, opts...)
+		if err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		} else if len(a) == 0 {
+			break
+		}
+		list = append(list, a...)
+	}
+	if len(list) != 6 || list[5].Val != "a" {
+		t.Fatalf("unexpected paged list: %v", list)
+	}
+
+	if pulled, err := cli.Pull(ctx, key, 2, 3*1e10+1); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	} else if len(pulled) != 2 {
+		t.Fatalf("unexpected pulled: %v", pulled)
+	}
+	if popped, err := cli.Pop(ctx, key, 1); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 1 || popped[0].Importance != 2 || popped[0].Id != ids[0] {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+}
+
+func TestPop(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	// importance: 1, 0, 1, 0, 1, 0
+	var ids []int64
+	for i := 0; i < 6; i++ {
+		if id, err := cli.Push(ctx, key, val, WithImportance(uint8(1-i%2))); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+
+	if popped, err := cli.Pop(ctx, key, 2); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 2 || popped[0].Id != ids[0] || popped[1].Id != ids[2] {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+	if popped, err := cli.Pop(ctx, key, 2, WithLowest()); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 2 || popped[0].Id != ids[1] || popped[1].Id != ids[3] {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+	if popped, err := cli.Pop(ctx, key, 10); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 2 || popped[0].Id != ids[4] || popped[1].Id != ids[5] {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+	if popped, err := cli.Pop(ctx, key, 1); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 0 {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+	if list, err := cli.List(ctx, key); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 0 {
+		t.Fatalf("unexpected list len: %v", len(list))
+	}
+}
+
+func TestMailDedup(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	id, err := cli.Push(ctx, key, val, WithDedupKey("reward"))
+	if err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	if id2, err := cli.Push(ctx, key, val, WithDedupKey("reward")); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	} else if id2 != id {
+		t.Fatalf("unexpected push id: %v", id2)
+	}
+	if id2, err := cli.Push(ctx, key, val, WithDedupKey("other")); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	} else if id2 == id {
+		t.Fatalf("unexpected push id: %v", id2)
+	}
+	if list, err := cli.List(ctx, key); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 2 || list[0].DedupKey != "reward" {
+		t.Fatalf("unexpected list: %v", list)
+	}
+	// dedup key is released after pulled
+	if _, err := cli.Pull(ctx, key, id); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	}
+	if id2, err := cli.Push(ctx, key, val, WithDedupKey("reward")); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	} else if id2 == id {
+		t.Fatalf("unexpected push id: %v", id2)
+	}
+}
+
+// 去重命中和拒绝插入不修改邮箱，不增加版本也不标记为脏
+func TestMailUnchanged(t *testing.T) {
+	const (
+		xDirtySet = "$DIRTYSET$"
+		xDirtyQue = "$DIRTYQUE$"
+	)
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	if _, err := cli.Push(ctx, key, val, WithDedupKey("reward")); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	// as if written back
+	r.Del(ctx, xDirtySet, xDirtyQue)
+	rev := rGetData(ctx, r, key).Rev
+
+	if _, err := cli.Push(ctx, key, val, WithDedupKey("reward")); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	if _, err := cli.Push(ctx, key, val, WithCapacity(1), WithEviction(EvictNone)); err != ErrMailBoxFull {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	if v := rGetData(ctx, r, key).Rev; v != rev {
+		t.Fatalf("unexpected rev: %v", v)
+	}
+	if n, err := r.LLen(ctx, xDirtyQue).Result(); err != nil || n != 0 {
+		t.Fatalf("unexpected dirty queue len: %v, %v", n, err)
+	}
+	if n, err := r.SCard(ctx, xDirtySet).Result(); err != nil || n != 0 {
+		t.Fatalf("unexpected dirty set len: %v, %v", n, err)
+	}
+}
+
+func TestMailEvict(t *testing.T) {
+	r, s := dial(t)
+	var evicted []int64
+	cli := NewClient(r, s, OnMailEvict(func(key string, a []*Mail) {
+		for _, m := range a {
+			evicted = append(evicted, m.Id)
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, c := range []struct {
+		base     []uint8
+		strategy EvictStrategy
+		imp      uint8
+		err      error
+		evicted  []int64
+	}{
+		{[]uint8{1, 0, 1}, EvictNone, 1, ErrMailBoxFull, nil},
+		{[]uint8{1, 0, 1}, EvictLeastImportant, 1, nil, []int64{2}},
+		{[]uint8{1, 1, 1}, EvictLeastImportant, 0, nil, []int64{4}},
+		{[]uint8{1, 1, 1}, EvictLessImportant, 0, ErrMailBoxFull, nil},
+		{[]uint8{1, 1, 1}, EvictLessImportant, 2, nil, []int64{1e10 + 1}},
+		{[]uint8{1, 0, 1}, EvictOldest, 0, nil, []int64{1e10 + 1}},
+		{[]uint8{1, 0, 1}, EvictNewest, 0, nil, []int64{1e10 + 3}},
+	} {
+		var key = fmt.Sprintf("%d", rand.Int())
+		r.Del(ctx, key)
+		for _, imp := range c.base {
+			if _, err := cli.Push(ctx, key, "hello", WithImportance(imp)); err != nil {
+				t.Fatalf("unexpected push err: %v", err)
+			}
+		}
+		evicted = nil
+		if _, err := cli.Push(ctx, key, "world", WithImportance(c.imp),
+			WithCapacity(3), WithEviction(c.strategy)); err != c.err {
+			t.Fatalf("unexpected push err: %v", err)
+		}
+		if fmt.Sprint(evicted) != fmt.Sprint(c.evicted) {
+			t.Fatalf("unexpected evicted: %v", evicted)
+		}
+		if list, err := cli.List(ctx, key); err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		} else if len(list) != 3 {
+			t.Fatalf("unexpected list len: %v", len(list))
+		}
+		r.Del(ctx, key)
+	}
+}
+
+func TestMailSchedule(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key)
+
+	now := time.Now()
+	var ids []int64
+	for _, opts := range [][]PushOption{
+		{},
+		{WithExpireAt(now.Add(-time.Hour))},
+		{WithVisibleAt(now.Add(time.Hour))},
+		{WithExpireAt(now.Add(time.Hour))},
+	} {
+		if id, err := cli.Push(ctx, key, val, opts...); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+
+	// expired and invisible mails are hidden
+	if list, err := cli.List(ctx, key); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 2 || list[0].Id != ids[0] || list[1].Id != ids[3] {
+		t.Fatalf("unexpected list: %v", list)
+	} else if list[1].ExpireAt != now.Add(time.Hour).UnixMilli() {
+		t.Fatalf("unexpected list elem: %v", list[1])
+	}
+	// expired mail is purged when mailbox is touched
+	if pulled, err := cli.Pull(ctx, key, ids[1]); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	} else if len(pulled) != 0 {
+		t.Fatalf("unexpected pulled: %v", pulled)
+	}
+	// invisible mail can not be popped
+	if popped, err := cli.Pop(ctx, key, 10); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	} else if len(popped) != 2 || popped[0].Id != ids[0] || popped[1].Id != ids[3] {
+		t.Fatalf("unexpected popped: %v", popped)
+	}
+	if pulled, err := cli.Pull(ctx, key, ids[2]); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	} else if len(pulled) != 1 {
+		t.Fatalf("unexpected pulled: %v", pulled)
+	}
+}
+
+func TestMailFlags(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		ch  = fmt.Sprintf("%d", rand.Int())
+		key = fmt.Sprintf("%d", rand.Int())
+	)
+	defer r.Del(ctx, ch, key)
+
+	r.Del(ctx, ch, key)
+
+	if _, err := cli.Count(ctx, key); err != ErrNotExists {
+		t.Fatalf("unexpected count err: %v", err)
+	}
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		if id, err := cli.Push(ctx, key, "hello"); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+
+	if marked, err := cli.Mark(ctx, key, []int64{ids[0], ids[1], 100}, MailRead); err != nil {
+		t.Fatalf("unexpected mark err: %v", err)
+	} else if len(marked) != 2 {
+		t.Fatalf("unexpected marked: %v", marked)
+	}
+	if _, err := cli.Mark(ctx, key, ids[1:2], MailClaimed); err != nil {
+		t.Fatalf("unexpected mark err: %v", err)
+	}
+
+	for _, c := range []struct {
+		opts []ListOption
+		n    int
+	}{
+		{nil, 3},
+		{[]ListOption{WithoutFlags(MailRead)}, 1},
+		{[]ListOption{WithoutFlags(MailClaimed)}, 2},
+		{[]ListOption{WithFlags(MailRead | MailClaimed)}, 1},
+	} {
+		if n, err := cli.Count(ctx, key, c.opts...); err != nil {
+			t.Fatalf("unexpected count err: %v", err)
+		} else if n != c.n {
+			t.Fatalf("unexpected count: %v", n)
+		}
+		if list, err := cli.List(ctx, key, c.opts...); err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		} else if len(list) != c.n {
+			t.Fatalf("unexpected list len: %v", len(list))
+		}
+	}
+
+	if _, err := cli.Unmark(ctx, key, ids[1:2], MailRead); err != nil {
+		t.Fatalf("unexpected unmark err: %v", err)
+	}
+	if list, err := cli.List(ctx, key, WithFlags(MailRead)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 1 || list[0].Id != ids[0] || !list[0].HasFlags(MailRead) {
+		t.Fatalf("unexpected list: %v", list)
+	}
+
+	// pending broadcast mails are unread
+	if _, err := cli.Push(ctx, ch, "broadcast"); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	if n, err := cli.Count(ctx, key, WithoutFlags(MailRead), WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected count err: %v", err)
+	} else if n != 3 {
+		t.Fatalf("unexpected count: %v", n)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		ch  = fmt.Sprintf("%d", rand.Int())
+		key = fmt.Sprintf("%d", rand.Int())
+	)
+	defer r.Del(ctx, ch, key)
+
+	r.Del(ctx, ch, key)
+
+	// the scheduled mail does not block mails after it
+	for _, opts := range [][]PushOption{
+		{WithImportance(1)},
+		{},
+		{WithVisibleAt(time.Now().Add(time.Hour))},
+		{},
+	} {
+		if _, err := cli.Push(ctx, ch, "broadcast", opts...); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		}
+	}
+
+	// mailbox not exists
+	if list, err := cli.List(ctx, key, WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 3 || list[0].Id != 1e10+1 || list[1].Id != 2 || list[2].Id != 4 || list[0].Channel != ch {
+		t.Fatalf("unexpected list: %v", list)
+	}
+
+	if _, err := cli.Push(ctx, key, "hello"); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	if list, err := cli.List(ctx, key, WithBroadcast(ch), WithMinImportance(1)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 1 || list[0].Channel != ch {
+		t.Fatalf("unexpected list: %v", list)
+	}
+	// channel mails are returned only on the first page
+	if list, err := cli.List(ctx, key, WithBroadcast(ch), WithAfter(1e10)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 0 {
+		t.Fatalf("unexpected list: %v", list)
+	}
+
+	if ids, err := cli.Materialize(ctx, key, ch); err != nil {
+		t.Fatalf("unexpected materialize err: %v", err)
+	} else if len(ids) != 3 || ids[0] != 1e10+2 || ids[1] != 3 || ids[2] != 4 {
+		t.Fatalf("unexpected materialized ids: %v", ids)
+	}
+	if ids, err := cli.Materialize(ctx, key, ch); err != nil {
+		t.Fatalf("unexpected materialize err: %v", err)
+	} else if len(ids) != 0 {
+		t.Fatalf("unexpected materialized ids: %v", ids)
+	}
+	if list, err := cli.List(ctx, key, WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 4 {
+		t.Fatalf("unexpected list len: %v", len(list))
+	} else {
+		for _, m := range list {
+			if m.Channel != "" {
+				t.Fatalf("unexpected list elem: %v", m)
+			}
+		}
+	}
+}
+
+func TestBroadcastPaging(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		ch  = fmt.Sprintf("%d", rand.Int())
+		key = fmt.Sprintf("%d", rand.Int())
+	)
+	defer r.Del(ctx, ch, key)
+
+	r.Del(ctx, ch, key)
+
+	if _, err := cli.Push(ctx, ch, "broadcast"); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := cli.Push(ctx, key, "hello"); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		}
+	}
+
+	var ids []int64
+	var chn int
+	opts := []ListOption{WithBroadcast(ch), WithLimit(2)}
+	for page := 0; page < 5; page++ {
+		list, err := cli.List(ctx, key, opts...)
+		if err != nil {
+			t.Fatalf("unexpected list err: %v", err)
+		}
+		var last *Mail
+		for _, m := range list {
+			if m.Channel != "" {
+				chn++
+			} else {
+				ids = append(ids, m.Id)
+				last = m
+			}
+		}
+		if last == nil {
+			break
+		}
+		opts = []ListOption{WithBroadcast(ch), WithLimit(2), WithAfterMail(last)}
+	}
+	if chn != 1 {
+		t.Fatalf("unexpected channel mails: %v", chn)
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+	if list, err := cli.List(ctx, key, WithBroadcast(ch), WithOffset(4)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 1 || list[0].Channel != "" {
+		t.Fatalf("unexpected list: %v", list)
+	}
+}
+
+func TestBroadcastScheduled(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		ch  = fmt.Sprintf("%d", rand.Int())
+		key = fmt.Sprintf("%d", rand.Int())
+	)
+	defer r.Del(ctx, ch, key)
+
+	r.Del(ctx, ch, key)
+
+	// a future mail followed by an immediate one
+	for _, opts := range [][]PushOption{
+		{WithVisibleAt(time.Now().Add(200 * time.Millisecond))},
+		{},
+	} {
+		if _, err := cli.Push(ctx, ch, "broadcast", opts...); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		}
+	}
+	if list, err := cli.List(ctx, key, WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 1 || list[0].Id != 2 {
+		t.Fatalf("unexpected list: %v", list)
+	}
+	if ids, err := cli.Materialize(ctx, key, ch); err != nil {
+		t.Fatalf("unexpected materialize err: %v", err)
+	} else if len(ids) != 1 {
+		t.Fatalf("unexpected materialized ids: %v", ids)
+	}
+
+	// the future mail is received once it becomes visible, the immediate one is not received again
+	time.Sleep(300 * time.Millisecond)
+	if list, err := cli.List(ctx, key, WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 2 || list[1].Id != 1 || list[1].Channel != ch {
+		t.Fatalf("unexpected list: %v", list)
+	}
+	if ids, err := cli.Materialize(ctx, key, ch); err != nil {
+		t.Fatalf("unexpected materialize err: %v", err)
+	} else if len(ids) != 1 {
+		t.Fatalf("unexpected materialized ids: %v", ids)
+	}
+	if ids, err := cli.Materialize(ctx, key, ch); err != nil {
+		t.Fatalf("unexpected materialize err: %v", err)
+	} else if len(ids) != 0 {
+		t.Fatalf("unexpected materialized ids: %v", ids)
+	}
+	if list, err := cli.List(ctx, key, WithBroadcast(ch)); err != nil {
+		t.Fatalf("unexpected list err: %v", err)
+	} else if len(list) != 2 || list[0].Channel != "" || list[1].Channel != "" {
+		t.Fatalf("unexpected list: %v", list)
+	}
+}
+
+type testMailHistory struct {
+	a   []*MailHistory
+	err error
+}
+
+func (h *testMailHistory) SaveMailHistory(ctx context.Context, a []*MailHistory) error {
+	if h.err != nil {
+		return h.err
+	}
+	h.a = append(h.a, a...)
+	return nil
+}
+
+func TestMailHistory(t *testing.T) {
+	const (
+		xDirtySet   = "$DIRTYSET$"
+		xDirtyQue   = "$DIRTYQUE$"
+		xDirtyLease = "$DIRTYLEASE$"
+		xDirtyOwner = "$DIRTYOWNER$"
+	)
+	r, s := dial(t)
+	h := &testMailHistory{}
+	cli := NewClient(r, s, WithMailHistory(h))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key = fmt.Sprintf("%d", rand.Int())
+	defer r.Del(ctx, key)
+
+	r.Del(ctx, key, xMailHistory, "$MAILHISLEASE$", xDirtySet, xDirtyQue, xDirtyLease, xDirtyOwner)
+
+	var ids []int64
+	for _, opts := range [][]PushOption{
+		{WithExpireAt(time.Now().Add(-time.Hour))},
+		{},
+		{},
+		{WithCapacity(2), WithRing()},
+	} {
+		if id, err := cli.Push(ctx, key, "hello", opts...); err != nil {
+			t.Fatalf("unexpected push err: %v", err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	// mails: 1 expired, 2 evicted, 3 pulled, 4 popped
+	if _, err := cli.Pull(ctx, key, ids[2]); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	}
+	if _, err := cli.Pop(ctx, key, 1); err != nil {
+		t.Fatalf("unexpected pop err: %v", err)
+	}
+
+	// history claimed by a crashed syncer is requeued after lease expired
+	if a, err := cli.run(ctx, "redmon_mb_history", xMailHistory, "crashed", 1, 100).StringSlice(); err != nil {
+		t.Fatalf("unexpected claim err: %v", err)
+	} else if len(a) != 4 || r.LLen(ctx, xMailHistory).Val() != 0 {
+		t.Fatalf("unexpected claimed history len: %v", len(a))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// history is requeued on failure
+	h.err = fmt.Errorf("sink failure")
+	if _, _, err := cli.Flush(ctx); err != h.err {
+		t.Fatalf("unexpected flush err: %v", err)
+	}
+	h.err = nil
+	if _, _, err := cli.Flush(ctx); err != nil {
+		t.Fatalf("unexpected flush err: %v", err)
+	}
+	if len(h.a) != 4 {
+		t.Fatalf("unexpected history len: %v", len(h.a))
+	}
+	for i, reason := range []string{MailExpired, MailEvicted, MailPulled, MailPopped} {
+		if m := h.a[i]; m.Key != key || m.Id != ids[i] || m.Val != "hello" || m.Reason != reason || m.At == 0 {
+			t.Fatalf("unexpected history: %v", m)
+		}
+	}
+	if n := r.LLen(ctx, xMailHistory).Val(); n != 0 {
+		t.Fatalf("unexpected history queue len: %v", n)
+	}
+	if n := r.ZCard(ctx, "$MAILHISLEASE$").Val(); n != 0 {
+		t.Fatalf("unexpected history lease len: %v", n)
+	}
+	// mail ids restart in a re-created mailbox, but revisions don't
+	if err := cli.Delete(ctx, key); err != nil {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+	if id, err := cli.Push(ctx, key, "hello"); err != nil {
+		t.Fatalf("unexpected push err: %v", err)
+	} else if id != ids[0] {
+		t.Fatalf("unexpected push id: %v", id)
+	}
+	if _, err := cli.Pull(ctx, key, ids[0]); err != nil {
+		t.Fatalf("unexpected pull err: %v", err)
+	}
+	if _, _, err := cli.Flush(ctx); err != nil {
+		t.Fatalf("unexpected flush err: %v", err)
+	}
+	if len(h.a) != 5 || h.a[4].Id != h.a[0].Id || h.a[4].Rev <= h.a[3].Rev || h.a[0].Rev == 0 {
+		t.Fatalf("unexpected history: %v", h.a)
+	}
+}
+
+func TestSync(t *testing.T) {
+	const (
+		xDirtySet = "$DIRTYSET$"
+		xDirtyQue = "$DIRTYQUE$"
+	)
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key, val = fmt.Sprintf("%d", rand.Int()), "hello"
+	r.Del(ctx, xDirtyQue, xDirtySet, key)
+
+	if _, _, err := cli.peek(ctx); err != redis.Nil {
+		t.Fatalf("unexpected peek error: %v", err)
+	}
+
+	b, _ := msgpack.Marshal(&xRedisData{Rev: 1, Val: val})
+	r.Set(ctx, key, b2s(b), 0)
+	r.SAdd(ctx, xDirtySet, key)
+	r.LPush(ctx, xDirtyQue, key)
+
+	if k, d, err := cli.peek(ctx); err != nil {
+		t.Fatalf("unexpected peek error: %v", err)
+	} else if k != key {
+		t.Fatalf("unexpected peek key: %v", k)
+	} else if d.Rev != 1 {
+		t.Fatalf("unexpected peek rev: %v", d.Rev)
+	} else if d.Val != val {
+		t.Fatalf("unexpected peek val: %v", d.Val)
+	}
+
+	if k, d, err := cli.next(ctx, key, 2); err != nil {
+		t.Fatalf("unexpected next error: %v", err)
+	} else if k != key {
+		t.Fatalf("unexpected next key: %v", k)
+	} else if d.Rev != 1 {
+		t.Fatalf("unexpected next rev: %v", d.Rev)
+	} else if d.Val != val {
+		t.Fatalf("unexpected next val: %v", d.Val)
+	}
+
+	if _, _, err := cli.next(ctx, key, 1); err != redis.Nil {
+		t.Fatalf("unexpected next error: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	const (
+		xDirtySet = "$DIRTYSET$"
+		xDirtyQue = "$DIRTYQUE$"
+	)
+	r, s := dial(t)
+	cli := NewClient(r, s,
+		WithTTL(time.Hour),
+		WithTTLPolicy(func(key string) time.Duration {
+			if strings.HasPrefix(key, "short:") {
+				return time.Minute
+			}
+			return 0
+		}),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var keys = []string{"long:hello", "short:hello", "short:world"}
+	r.Del(ctx, append(keys, xDirtyQue, xDirtySet)...)
+	defer r.Del(ctx, keys...)
+
+	for _, key := range keys {
+		rSetData(ctx, r, key, xRedisData{Rev: 0})
+	}
+	for i, key := range keys {
+		var opts []SetOption
+		if i == 2 {
+			opts = append(opts, WithSyncTTL(time.Second*10))
+		}
+		if _, err := cli.Set(ctx, key, "hello", opts...); err != nil {
+			t.Fatalf("unexpected set err: %v", err)
+		}
+		if d := r.TTL(ctx, key).Val(); d != -1 {
+			t.Fatalf("unexpected dirty ttl: %v", d)
+		}
+	}
+	for _, ttl := range []time.Duration{time.Hour, time.Minute, 10 * time.Second} {
+		k, d, err := cli.peek(ctx)
+		if err != nil {
+			t.Fatalf("unexpected peek error: %v", err)
+		}
+		if _, _, err = cli.next(ctx, k, d.Rev); err != nil && err != redis.Nil {
+			t.Fatalf("unexpected next error: %v", err)
+		}
+		if d := r.TTL(ctx, k).Val(); d != ttl {
+			t.Fatalf("unexpected synced ttl: %v, %v", k, d)
+		}
+	}
+
+	// sync ttl is cleared by any later write
+	if _, err := cli.Set(ctx, keys[2], "hello", WithSyncTTL(time.Second*10)); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	if err := cli.Delete(ctx, keys[2]); err != nil {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+	if d := rGetData(ctx, r, keys[2]); d.Ex != 0 {
+		t.Fatalf("unexpected sync ttl: %v", d.Ex)
+	}
+}
+
+// fails every save
+type testFailStore struct {
+	*MemStore
+}
+
+func (s testFailStore) SaveMany(ctx context.Context, entries []Entry) []error {
+	errs := make([]error, len(entries))
+	for i := range errs {
+		errs[i] = errors.New("save failed")
+	}
+	return errs
+}
+
+func TestSyncBackoff(t *testing.T) {
+	const (
+		xDirtySet   = "$DIRTYSET$"
+		xDirtyQue   = "$DIRTYQUE$"
+		xDirtyLease = "$DIRTYLEASE$"
+		xDirtyOwner = "$DIRTYOWNER$"
+	)
+	r, _ := dial(t)
+	var fails int
+	cli := NewClient(r, testFailStore{NewMemStore()}, OnSyncFail(func(err error) time.Duration {
+		fails++
+		return time.Second
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("%d", rand.Int()))
+	}
+	r.Del(ctx, append(keys, xDirtySet, xDirtyQue, xDirtyLease, xDirtyOwner)...)
+	defer r.Del(ctx, keys...)
+
+	for _, key := range keys {
+		if _, err := cli.Set(ctx, key, "hello"); err != nil {
+			t.Fatalf("unexpected set err: %v", err)
+		}
+	}
+
+	// back off once per batch, leases are released before waiting
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	cli.Sync(sctx, WithBatch(len(keys)))
+	if fails != len(keys) {
+		t.Fatalf("unexpected fails: %v", fails)
+	}
+	if n := r.ZCard(ctx, xDirtyLease).Val(); n != 0 {
+		t.Fatalf("unexpected dirty lease: %v", n)
+	}
+	if n := r.LLen(ctx, xDirtyQue).Val(); n != int64(len(keys)) {
+		t.Fatalf("unexpected dirty queue: %v", n)
+	}
+}
+
+func TestSyncLease(t *testing.T) {
+	const (
+		xDirtySet   = "$DIRTYSET$"
+		xDirtyQue   = "$DIRTYQUE$"
+		xDirtyLease = "$DIRTYLEASE$"
+		xDirtyOwner = "$DIRTYOWNER$"
+	)
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var keys = []string{"hello1", "hello2", "hello3"}
+	r.Del(ctx, append(keys, xDirtySet, xDirtyQue, xDirtyLease, xDirtyOwner)...)
+	defer r.Del(ctx, keys...)
+
+	for _, key := range keys {
+		rSetData(ctx, r, key, xRedisData{Rev: 0})
+		if _, err := cli.Set(ctx, key, "hello"); err != nil {
+			t.Fatalf("unexpected set err: %v", err)
+		}
+	}
+
+	w1 := &xLeaseWorker{cli: cli, id: "w1", lease: time.Minute}
+	w2 := &xLeaseWorker{cli: cli, id: "w2", lease: 10 * time.Millisecond}
+	w3 := &xLeaseWorker{cli: cli, id: "w3", lease: time.Minute, batch: 2}
+
+	// workers claim different keys
+	a1, err := w1.claim(ctx, nil)
+	if err != nil || len(a1) != 1 || a1[0].key != keys[0] {
+		t.Fatalf("unexpected claim: %v, %v", a1, err)
+	}
+	a2, err := w2.claim(ctx, nil)
+	if err != nil || len(a2) != 1 || a2[0].key != keys[1] {
+		t.Fatalf("unexpected claim: %v, %v", a2, err)
+	}
+	if a, err := w1.claim(ctx, []xSyncAck{{a1[0].key, a1[0].data.Rev, true}}); err != nil || len(a) != 1 || a[0].key != keys[2] {
+		t.Fatalf("unexpected claim: %v, %v", a, err)
+	}
+	if n := r.SCard(ctx, xDirtySet).Val(); n != 2 {
+		t.Fatalf("unexpected dirty set: %v", n)
+	}
+
+	// lease of crashed worker expires and the key is claimed again
+	time.Sleep(20 * time.Millisecond)
+	k2 := a2[0].key
+	if a, err := w3.claim(ctx, nil); err != nil || len(a) != 1 || a[0].key != k2 {
+		t.Fatalf("unexpected claim: %v, %v", a, err)
+	}
+	// late ack from the expired owner is ignored
+	if _, err := w2.claim(ctx, []xSyncAck{{k2, 1, true}}); err != redis.Nil {
+		t.Fatalf("unexpected claim: %v", err)
+	}
+	if owner := r.HGet(ctx, xDirtyOwner, k2).Val(); owner != "w3" {
+		t.Fatalf("unexpected owner: %v", owner)
+	}
+
+	// key modified while syncing is queued again
+	cli.Set(ctx, k2, "world")
+	if a, err := w3.claim(ctx, []xSyncAck{{k2, 1, true}}); err != nil || len(a) != 1 || a[0].key != k2 || a[0].data.Rev != 2 {
+		t.Fatalf("unexpected claim: %v, %v", a, err)
+	}
+
+	// failed key is queued again, only the saved one is cleaned
+	if _, err := w1.claim(ctx, []xSyncAck{{keys[2], 1, true}}); err != redis.Nil {
+		t.Fatalf("unexpected claim: %v", err)
+	}
+	cli.Set(ctx, keys[0], "world")
+	if a, err := w3.claim(ctx, []xSyncAck{{k2, 2, false}}); err != nil || len(a) != 2 || a[0].key != keys[0] || a[1].key != k2 {
+		t.Fatalf("unexpected claim: %v, %v", a, err)
+	}
+	if n := r.SCard(ctx, xDirtySet).Val(); n != 2 {
+		t.Fatalf("unexpected dirty set: %v", n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	const (
+		xDirtySet   = "$DIRTYSET$"
+		xDirtyQue   = "$DIRTYQUE$"
+		xDirtyLease = "$DIRTYLEASE$"
+		xDirtyOwner = "$DIRTYOWNER$"
+	)
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		database   = "test"
+		collection = "redmon"
+		keys       []string
+		ids        []string
+	)
+	for i := 0; i < 3; i++ {
+		_id := fmt.Sprintf("%d", rand.Int())
+		ids = append(ids, _id)
+		keys = append(keys, fmt.Sprintf("%s:%s:%s", database, collection, _id))
+	}
+	r.Del(ctx, append(keys, xDirtySet, xDirtyQue, xDirtyLease, xDirtyOwner)...)
+	defer r.Del(ctx, keys...)
+
+	for _, key := range keys {
+		if _, err := cli.Set(ctx, key, "hello"); err != nil {
+			t.Fatalf("unexpected set err: %v", err)
+		}
+	}
+
+	// flush specified keys only
+	if n, failed, err := cli.Flush(ctx, keys[0]); err != nil {
+		t.Fatalf("unexpected flush err: %v", err)
+	} else if n != 1 || len(failed) != 0 {
+		t.Fatalf("unexpected flush ret: %v, %v", n, failed)
+	}
+	if n := r.SCard(ctx, xDirtySet).Val(); n != 2 {
+		t.Fatalf("unexpected dirty set: %v", n)
+	}
+
+	// flush all
+	if n, failed, err := cli.Flush(ctx); err != nil {
+		t.Fatalf("unexpected flush err: %v", err)
+	} else if n != 2 || len(failed) != 0 {
+		t.Fatalf("unexpected flush ret: %v, %v", n, failed)
+	}
+	if n := r.SCard(ctx, xDirtySet).Val(); n != 0 {
+		t.Fatalf("unexpected dirty set: %v", n)
+	}
+	for _, key := range keys {
+		if rev, val, err := storeLoad(ctx, s, key); err != nil {
+			t.Fatalf("unexpected load err: %v", err)
+		} else if rev != 1 || val != "hello" {
+			t.Fatalf("unexpected flushed data: %v, %v", rev, val)
+		}
+	}
+
+	// stale data is skipped
+	r.Del(ctx, keys[0])
+	rSetData(ctx, r, keys[0], xRedisData{Rev: 0})
+	if _, err := cli.Set(ctx, keys[0], "world"); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	if n, failed, err := cli.Flush(ctx); err != nil {
+		t.Fatalf("unexpected flush err: %v", err)
+	} else if n != 1 || len(failed) != 0 {
+		t.Fatalf("unexpected flush ret: %v, %v", n, failed)
+	}
+	if _, val, err := storeLoad(ctx, s, keys[0]); err != nil {
+		t.Fatalf("unexpected load err: %v", err)
+	} else if val != "hello" {
+		t.Fatalf("unexpected flushed data: %v", val)
+	}
+	// lease left by an interrupted flush expires and is picked up by the default Sync
+	if _, err := cli.Set(ctx, keys[1], "world"); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	w := &xLeaseWorker{cli: cli, id: newWorkerId(), lease: time.Millisecond}
+	if _, err := w.claimKeys(ctx, keys[1:2]); err != nil {
+		t.Fatalf("unexpected claim err: %v", err)
+	}
+	if _, err := cli.Set(ctx, keys[1], "again"); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	cli.Sync(ctx, WithDrain())
+	if _, val, err := storeLoad(ctx, s, keys[1]); err != nil {
+		t.Fatalf("unexpected load err: %v", err)
+	} else if val != "again" {
+		t.Fatalf("unexpected synced data: %v", val)
+	}
+	if n := r.ZCard(ctx, xDirtyLease).Val(); n != 0 {
+		t.Fatalf("unexpected dirty lease: %v", n)
 	}
 }
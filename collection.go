@@ -0,0 +1,130 @@
+package redmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// 数据编解码器
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+var (
+	MsgpackCodec Codec = msgpackCodec{}
+	JSONCodec    Codec = jsonCodec{}
+	// 数据类型必须是proto.Message，如*pb.Player
+	ProtoCodec Codec = protoCodec{}
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error)   { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(b []byte, v any) error { return msgpack.Unmarshal(b, v) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("redmon: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+func (protoCodec) Unmarshal(b []byte, v any) error {
+	// v is usually a pointer to message pointer, allocate the message if nil
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+		if e := rv.Elem(); e.Kind() == reflect.Ptr {
+			if e.IsNil() {
+				e.Set(reflect.New(e.Type().Elem()))
+			}
+			v = e.Interface()
+		}
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("redmon: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// 类型化数据集合，在Client之上通过Codec编解码数据
+type Collection[T any] struct {
+	cli   *Client
+	codec Codec
+}
+
+func NewCollection[T any](cli *Client, codec Codec) *Collection[T] {
+	return &Collection[T]{cli: cli, codec: codec}
+}
+
+func (c *Collection[T]) encode(v T) (_ string, err error) {
+	b, err := c.codec.Marshal(v)
+	if err != nil {
+		return
+	}
+	return b2s(b), nil
+}
+
+func (c *Collection[T]) decode(s string) (v T, err error) {
+	err = c.codec.Unmarshal(s2b(s), &v)
+	return
+}
+
+// 获取数据，参见Client.Get
+func (c *Collection[T]) Get(ctx context.Context, key string, opts ...GetOption) (rev int64, v T, err error) {
+	var s string
+	if rev, s, err = c.cli.Get(ctx, key, opts...); err != nil {
+		return
+	}
+	v, err = c.decode(s)
+	return
+}
+
+// 设置数据，参见Client.Set
+func (c *Collection[T]) Set(ctx context.Context, key string, v T, opts ...SetOption) (rev int64, err error) {
+	s, err := c.encode(v)
+	if err != nil {
+		return
+	}
+	return c.cli.Set(ctx, key, s, opts...)
+}
+
+// 新增数据，参见Client.Add
+func (c *Collection[T]) Add(ctx context.Context, key string, v T) (err error) {
+	s, err := c.encode(v)
+	if err != nil {
+		return
+	}
+	return c.cli.Add(ctx, key, s)
+}
+
+// 原子地更新数据，参见Client.Update，数据不存在时v为零值
+func (c *Collection[T]) Update(
+	ctx context.Context, key string,
+	f func(rev int64, v T, exists bool) (T, error),
+	opts ...UpdateOption) (rev int64, retries int, err error) {
+	return c.cli.Update(ctx, key, func(rev int64, s string, exists bool) (_ string, err error) {
+		var v T
+		if exists {
+			if v, err = c.decode(s); err != nil {
+				return
+			}
+		}
+		if v, err = f(rev, v, exists); err != nil {
+			return
+		}
+		return c.encode(v)
+	}, opts...)
+}
@@ -0,0 +1,65 @@
+package redmon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type xTestPlayer struct {
+	Name  string `msgpack:"name" json:"name"`
+	Level int    `msgpack:"level" json:"level"`
+}
+
+func TestCollection(t *testing.T) {
+	r, s := dial(t)
+	cli := NewClient(r, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var key = "hello"
+	defer r.Del(ctx, key)
+
+	for _, codec := range []Codec{MsgpackCodec, JSONCodec} {
+		r.Del(ctx, key)
+		rSetData(ctx, r, key, xRedisData{Rev: 0})
+
+		c := NewCollection[xTestPlayer](cli, codec)
+		if _, _, err := c.Get(ctx, key); err != ErrNotExists {
+			t.Fatalf("unexpected get err: %v", err)
+		}
+		if err := c.Add(ctx, key, xTestPlayer{Name: "foo", Level: 1}); err != nil {
+			t.Fatalf("unexpected add err: %v", err)
+		}
+		if rev, _, err := c.Update(ctx, key, func(rev int64, v xTestPlayer, exists bool) (xTestPlayer, error) {
+			v.Level++
+			return v, nil
+		}); err != nil {
+			t.Fatalf("unexpected update err: %v", err)
+		} else if rev != 2 {
+			t.Fatalf("unexpected update rev: %v", rev)
+		}
+		if rev, v, err := c.Get(ctx, key); err != nil {
+			t.Fatalf("unexpected get err: %v", err)
+		} else if rev != 2 || v.Name != "foo" || v.Level != 2 {
+			t.Fatalf("unexpected get ret: %v, %v", rev, v)
+		}
+	}
+
+	r.Del(ctx, key)
+	rSetData(ctx, r, key, xRedisData{Rev: 0})
+	c := NewCollection[*wrapperspb.StringValue](cli, ProtoCodec)
+	if rev, err := c.Set(ctx, key, wrapperspb.String("foo")); err != nil {
+		t.Fatalf("unexpected set err: %v", err)
+	} else if rev != 1 {
+		t.Fatalf("unexpected set rev: %v", rev)
+	}
+	if rev, v, err := c.Get(ctx, key); err != nil {
+		t.Fatalf("unexpected get err: %v", err)
+	} else if rev != 1 || v.GetValue() != "foo" {
+		t.Fatalf("unexpected get ret: %v, %v", rev, v)
+	}
+}
@@ -0,0 +1,132 @@
+package redmon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 邮件被删除的原因
+const (
+	MailPulled  = "pull"
+	MailPopped  = "pop"
+	MailEvicted = "evict"
+	MailExpired = "expire"
+)
+
+// 邮件历史在REDIS中的队列
+const xMailHistory = "$MAILHIS$"
+
+// 每次领取的邮件历史数量
+const defaultHistoryBatch = 100
+
+// 被删除的邮件
+type MailHistory struct {
+	// mailbox key
+	Key string `msgpack:"key"`
+	// mailbox revision of the removal, unique across mailbox re-creations
+	Rev int64 `msgpack:"rev"`
+	// mail id
+	Id int64 `msgpack:"id"`
+	// mail payload
+	Val string `msgpack:"val"`
+	// removed reason, MailPulled/MailPopped/MailEvicted/MailExpired
+	Reason string `msgpack:"why"`
+	// removed at unix milliseconds
+	At int64 `msgpack:"at"`
+}
+
+// 邮件历史存储，由Sync回写，写入可能重复，实现应保证幂等
+type MailHistorySink interface {
+	SaveMailHistory(ctx context.Context, a []*MailHistory) error
+}
+
+// 以租约方式领取一批邮件历史写入存储，写入成功后删除，失败时重新入队
+// 进程在写入后确认前退出时，租约到期后重新入队，因此写入可能重复但不会丢失
+// 返回写入的数量，没有邮件历史时返回0
+func (cli *Client) syncHistory(ctx context.Context) (n int, err error) {
+	if cli.mailHistorySink == nil {
+		return
+	}
+	id := newWorkerId()
+	r, err := cli.run(ctx, "redmon_mb_history", xMailHistory,
+		id, defaultSyncLease.Milliseconds(), defaultHistoryBatch).StringSlice()
+	if err != nil || len(r) == 0 {
+		return
+	}
+	// 最早的在最后，按删除顺序写入
+	a := make([]*MailHistory, len(r))
+	for i, s := range r {
+		if err = msgpack.Unmarshal(s2b(s), &a[len(r)-1-i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = cli.mailHistorySink.SaveMailHistory(ctx, a)
+	}
+	if err != nil {
+		if e := cli.run(ctx, "redmon_mb_history_ack", xMailHistory, id, "").Err(); e != nil {
+			err = fmt.Errorf("%w, and requeue failed: %v", err, e)
+		}
+		return
+	}
+	if err = cli.run(ctx, "redmon_mb_history_ack", xMailHistory, id, "1").Err(); err != nil {
+		return
+	}
+	return len(a), nil
+}
+
+// MongoDB邮件历史存储，与邮箱文档写入相同的database，collection可配置
+// 文档_id由邮箱的collection、_id、删除时的邮箱修订和邮件ID组成，重复写入被忽略
+type MongoMailHistory struct {
+	mdb            *mongo.Client
+	keyMappingFunc KeyMappingFunc
+	collection     string
+}
+
+var _ MailHistorySink = (*MongoMailHistory)(nil)
+
+// keyMap应与MongoStore一致，nil时使用默认映射规则
+func NewMongoMailHistory(mdb *mongo.Client, keyMap KeyMappingFunc, collection string) *MongoMailHistory {
+	return &MongoMailHistory{mdb: mdb, keyMappingFunc: keyMap, collection: collection}
+}
+
+// One unordered InsertMany for each database
+func (h *MongoMailHistory) SaveMailHistory(ctx context.Context, a []*MailHistory) error {
+	groups := make(map[string][]any)
+	for _, m := range a {
+		database, collection, _id := h.keyMappingFunc.mapKey(m.Key)
+		groups[database] = append(groups[database], bson.M{
+			"_id":    fmt.Sprintf("%s:%s:%d:%d", collection, _id, m.Rev, m.Id),
+			"coll":   collection,
+			"box":    _id,
+			"rev":    m.Rev,
+			"id":     m.Id,
+			"val":    s2b(m.Val),
+			"reason": m.Reason,
+			"at":     time.UnixMilli(m.At),
+		})
+	}
+	for database, docs := range groups {
+		_, err := h.mdb.Database(database).Collection(h.collection).InsertMany(
+			ctx, docs, options.InsertMany().SetOrdered(false))
+		if e, ok := err.(mongo.BulkWriteException); ok && e.WriteConcernError == nil {
+			err = nil
+			for _, we := range e.WriteErrors {
+				if we.Code != errDuplicateKey {
+					err = we
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
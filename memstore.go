@@ -0,0 +1,75 @@
+package redmon
+
+import (
+	"context"
+	"sync"
+)
+
+// 内存存储，数据只保存在进程内，用于测试或无需持久化的场景
+type MemStore struct {
+	mu   sync.RWMutex
+	data map[string]Entry
+}
+
+var _ Store = (*MemStore)(nil)
+
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string]Entry)}
+}
+
+func (s *MemStore) load(key string) (int64, string, error) {
+	e, ok := s.data[key]
+	if !ok || e.Del {
+		return e.Rev, "", ErrNotExists
+	}
+	return e.Rev, e.Val, nil
+}
+
+func (s *MemStore) Load(ctx context.Context, key string) (res Result, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if res.Rev, res.Val, res.Err = s.load(key); res.Err == nil {
+		res.Hash = s.data[key].Hash
+	}
+	return
+}
+
+func (s *MemStore) LoadMany(ctx context.Context, keys []string) ([]Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a := make([]Result, len(keys))
+	for i, key := range keys {
+		if a[i].Rev, a[i].Val, a[i].Err = s.load(key); a[i].Err == nil {
+			a[i].Hash = s.data[key].Hash
+		}
+	}
+	return a, nil
+}
+
+func (s *MemStore) Save(ctx context.Context, key string, rev int64, val string) error {
+	return s.SaveMany(ctx, []Entry{{Key: key, Rev: rev, Val: val}})[0]
+}
+
+// 软删除，保留墓碑修订
+func (s *MemStore) Delete(ctx context.Context, key string, rev int64) error {
+	return s.SaveMany(ctx, []Entry{{Key: key, Rev: rev, Del: true}})[0]
+}
+
+// 只有已保存的修订小于待保存修订时才会写入，哈希数据总是整体写入
+func (s *MemStore) SaveMany(ctx context.Context, entries []Entry) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		if old, ok := s.data[e.Key]; ok && old.Rev >= e.Rev {
+			errs[i] = ErrStaleWrite
+			continue
+		}
+		if e.Del {
+			e.Val, e.Hash = "", false
+		}
+		e.Fields = nil
+		s.data[e.Key] = e
+	}
+	return errs
+}
@@ -0,0 +1,226 @@
+package redmon
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB duplicate key error code
+const errDuplicateKey = 11000
+
+// MONGO存储数据对象
+// 删除采用软删除，保留墓碑修订，防止过期的回写使数据复活
+// 哈希数据保存为hash子文档，没有val字段
+type xMongoData struct {
+	Rev  int64             `msgpack:"rev" bson:"rev" json:"rev"`
+	Val  []byte            `msgpack:"val" bson:"val" json:"val"`
+	Del  bool              `msgpack:"del" bson:"del" json:"del"`
+	Hash map[string]string `msgpack:"hash" bson:"hash,omitempty" json:"hash,omitempty"`
+}
+
+// 哈希数据编码为msgpack map
+func (d *xMongoData) value() (val string, hash bool, err error) {
+	if d.Hash == nil {
+		return b2s(d.Val), false, nil
+	}
+	val, err = encodeHash(d.Hash)
+	return val, true, err
+}
+
+// 哈希字段能否作为更新子路径
+func mongoSubPath(field string) bool {
+	return field != "" && field[0] != '$' && !strings.Contains(field, ".")
+}
+
+// 更新文档，哈希数据指定Fields且字段名都能作为子路径时只更新这些字段
+func mongoUpdate(e Entry) (bson.M, error) {
+	set, unset := bson.M{"rev": e.Rev, "del": e.Del}, bson.M{}
+	if !e.Hash || e.Del {
+		set["val"] = s2b(e.Val)
+		unset["hash"] = ""
+	} else {
+		h, err := decodeHash(e.Val)
+		if err != nil {
+			return nil, err
+		}
+		partial := e.Fields != nil
+		for _, f := range e.Fields {
+			partial = partial && mongoSubPath(f)
+		}
+		if partial {
+			for _, f := range e.Fields {
+				if v, ok := h[f]; ok {
+					set["hash."+f] = v
+				} else {
+					unset["hash."+f] = ""
+				}
+			}
+		} else {
+			set["hash"] = h
+		}
+		unset["val"] = ""
+	}
+	return bson.M{"$set": set, "$unset": unset}, nil
+}
+
+// MongoDB存储，数据按KeyMappingFunc映射到(database, collection, _id)
+type MongoStore struct {
+	mdb            *mongo.Client
+	keyMappingFunc KeyMappingFunc
+}
+
+var _ Store = (*MongoStore)(nil)
+
+// keyMap为nil时使用默认映射规则
+func NewMongoStore(mdb *mongo.Client, keyMap KeyMappingFunc) *MongoStore {
+	return &MongoStore{mdb: mdb, keyMappingFunc: keyMap}
+}
+
+func (s *MongoStore) Load(ctx context.Context, key string) (res Result, err error) {
+	database, collection, _id := s.keyMappingFunc.mapKey(key)
+	var data xMongoData
+	if err = s.mdb.Database(database).Collection(collection).FindOne(
+		ctx, bson.M{"_id": _id}).Decode(&data); err != nil {
+		if err == mongo.ErrNoDocuments {
+			res.Err, err = ErrNotExists, nil
+		}
+		return
+	}
+	if res.Rev = data.Rev; data.Del {
+		res.Err = ErrNotExists
+		return
+	}
+	res.Val, res.Hash, err = data.value()
+	return
+}
+
+// One query for each (database, collection) group
+func (s *MongoStore) LoadMany(ctx context.Context, keys []string) (a []Result, err error) {
+	type group struct {
+		database, collection string
+	}
+	groups := make(map[group]map[string][]int)
+	a = make([]Result, len(keys))
+	for i, key := range keys {
+		database, collection, _id := s.keyMappingFunc.mapKey(key)
+		g := group{database, collection}
+		if groups[g] == nil {
+			groups[g] = make(map[string][]int)
+		}
+		groups[g][_id] = append(groups[g][_id], i)
+		a[i].Err = ErrNotExists
+	}
+	for g, m := range groups {
+		ids := make([]string, 0, len(m))
+		for _id := range m {
+			ids = append(ids, _id)
+		}
+		cur, err := s.mdb.Database(g.database).Collection(g.collection).Find(
+			ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, err
+		}
+		for cur.Next(ctx) {
+			var data xMongoData
+			if err = cur.Decode(&data); err != nil {
+				break
+			}
+			var (
+				val  string
+				hash bool
+			)
+			if val, hash, err = data.value(); err != nil {
+				break
+			}
+			for _, i := range m[cur.Current.Lookup("_id").StringValue()] {
+				if a[i].Rev = data.Rev; !data.Del {
+					a[i].Val, a[i].Err, a[i].Hash = val, nil, hash
+				}
+			}
+		}
+		if err == nil {
+			err = cur.Err()
+		}
+		cur.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (s *MongoStore) Save(ctx context.Context, key string, rev int64, val string) error {
+	return s.SaveMany(ctx, []Entry{{Key: key, Rev: rev, Val: val}})[0]
+}
+
+// 软删除，保留墓碑修订
+func (s *MongoStore) Delete(ctx context.Context, key string, rev int64) error {
+	return s.SaveMany(ctx, []Entry{{Key: key, Rev: rev, Del: true}})[0]
+}
+
+// 按(database, collection)分组，每组执行一次无序BulkWrite
+// 只有DB中的修订小于待保存修订时才会写入，防止过期的回写覆盖更新的数据
+// 哈希数据指定Entry.Fields时以$set/$unset只写入修改的字段
+func (s *MongoStore) SaveMany(ctx context.Context, entries []Entry) (errs []error) {
+	type group struct {
+		database, collection string
+	}
+	groups := make(map[group][]int)
+	for i, e := range entries {
+		database, collection, _ := s.keyMappingFunc.mapKey(e.Key)
+		g := group{database, collection}
+		groups[g] = append(groups[g], i)
+	}
+	errs = make([]error, len(entries))
+	for g, idx := range groups {
+		// 修订过滤不匹配时upsert会因_id重复而失败，但也可能是并发插入导致，
+		// 重试一次，仍然重复则说明DB中的数据更新
+		for retried := false; len(idx) > 0; retried = true {
+			models := make([]mongo.WriteModel, 0, len(idx))
+			// index of entry for each model
+			midx := make([]int, 0, len(idx))
+			for _, i := range idx {
+				e := entries[i]
+				_, _, _id := s.keyMappingFunc.mapKey(e.Key)
+				update, err := mongoUpdate(e)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				models = append(models, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"_id": _id, "rev": bson.M{"$lt": e.Rev}}).
+					SetUpdate(update).
+					SetUpsert(true))
+				midx = append(midx, i)
+			}
+			if len(models) == 0 {
+				break
+			}
+			_, err := s.mdb.Database(g.database).Collection(g.collection).BulkWrite(
+				ctx, models, options.BulkWrite().SetOrdered(false))
+			var dup []int
+			if e, ok := err.(mongo.BulkWriteException); ok && e.WriteConcernError == nil {
+				for _, we := range e.WriteErrors {
+					i := midx[we.Index]
+					if we.Code != errDuplicateKey {
+						errs[i] = we
+					} else if retried {
+						errs[i] = ErrStaleWrite
+					} else {
+						dup = append(dup, i)
+					}
+				}
+			} else if err != nil {
+				for _, i := range midx {
+					errs[i] = err
+				}
+			}
+			idx = dup
+		}
+	}
+	return
+}
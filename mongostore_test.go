@@ -0,0 +1,99 @@
+package redmon
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoStore(t *testing.T) {
+	testStore(t, NewMongoStore(dialMongo(t), nil))
+}
+
+func TestMongoUpdate(t *testing.T) {
+	hash, _ := encodeHash(map[string]string{"a": "1", "c": "3"})
+	for _, c := range []struct {
+		e          Entry
+		set, unset bson.M
+	}{
+		// whole hash
+		{
+			Entry{Rev: 1, Val: hash, Hash: true},
+			bson.M{"rev": int64(1), "del": false, "hash": map[string]string{"a": "1", "c": "3"}},
+			bson.M{"val": ""},
+		},
+		// changed fields only, absent field is unset
+		{
+			Entry{Rev: 2, Val: hash, Hash: true, Fields: []string{"a", "b"}},
+			bson.M{"rev": int64(2), "del": false, "hash.a": "1"},
+			bson.M{"val": "", "hash.b": ""},
+		},
+		// nothing changed
+		{
+			Entry{Rev: 3, Val: hash, Hash: true, Fields: []string{}},
+			bson.M{"rev": int64(3), "del": false},
+			bson.M{"val": ""},
+		},
+		// field names not usable as sub-path
+		{
+			Entry{Rev: 4, Val: hash, Hash: true, Fields: []string{"a", "x.y"}},
+			bson.M{"rev": int64(4), "del": false, "hash": map[string]string{"a": "1", "c": "3"}},
+			bson.M{"val": ""},
+		},
+		{
+			Entry{Rev: 5, Val: hash, Hash: true, Fields: []string{"$a"}},
+			bson.M{"rev": int64(5), "del": false, "hash": map[string]string{"a": "1", "c": "3"}},
+			bson.M{"val": ""},
+		},
+		// plain value
+		{
+			Entry{Rev: 6, Val: "hello"},
+			bson.M{"rev": int64(6), "del": false, "val": []byte("hello")},
+			bson.M{"hash": ""},
+		},
+		// tombstone drops hash
+		{
+			Entry{Rev: 7, Del: true, Hash: true, Fields: []string{"a"}},
+			bson.M{"rev": int64(7), "del": true, "val": s2b("")},
+			bson.M{"hash": ""},
+		},
+	} {
+		u, err := mongoUpdate(c.e)
+		if err != nil {
+			t.Fatalf("unexpected update err: %v", err)
+		}
+		if !reflect.DeepEqual(u["$set"], c.set) || !reflect.DeepEqual(u["$unset"], c.unset) {
+			t.Fatalf("unexpected update of %v: %v", c.e, u)
+		}
+	}
+
+	if _, err := mongoUpdate(Entry{Rev: 1, Val: "bad", Hash: true}); err == nil {
+		t.Fatalf("unexpected update of bad hash")
+	}
+}
+
+func TestMongoMailHistory(t *testing.T) {
+	h := NewMongoMailHistory(dialMongo(t), nil, "history")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	a := []*MailHistory{{
+		Key:    fmt.Sprintf("test:redmon:%d", rand.Int()),
+		Id:     1,
+		Val:    "hello",
+		Reason: MailPulled,
+		At:     time.Now().UnixMilli(),
+	}}
+	// duplicated history is ignored
+	for i := 0; i < 2; i++ {
+		if err := h.SaveMailHistory(ctx, a); err != nil {
+			t.Fatalf("unexpected save err: %v", err)
+		}
+	}
+}
@@ -8,22 +8,39 @@ import (
 // Redis(key) -> Mongo(db,collection,_id)
 type KeyMappingFunc func(key string) (db, collection, _id string)
 
+// 数据过期时长策略，返回0使用默认过期时长
+type TTLPolicyFunc func(key string) time.Duration
+
 // 同步成功回调函数
 type OnSyncSaveFunc func(key string) time.Duration
 
+// 同步跳过回调函数，DB中已存在相同或更新修订的数据
+type OnSyncStaleFunc func(key string, rev int64) time.Duration
+
 // 同步失败回调函数
 type OnSyncFailFunc func(err error) time.Duration
 
 // 同步空闲回调函数
 type OnSyncIdleFunc func() time.Duration
 
+// 邮件淘汰回调函数，可用于归档被淘汰的邮件
+type OnMailEvictFunc func(key string, evicted []*Mail)
+
 // Client Options
 type (
 	xOptions struct {
-		keyMappingFunc KeyMappingFunc
-		onSyncSaveFunc OnSyncSaveFunc
-		onSyncFailFunc OnSyncFailFunc
-		onSyncIdleFunc OnSyncIdleFunc
+		// 已回写数据的默认过期时长，0使用脚本默认值(1天)
+		ttl             time.Duration
+		ttlPolicyFunc   TTLPolicyFunc
+		onSyncSaveFunc  OnSyncSaveFunc
+		onSyncStaleFunc OnSyncStaleFunc
+		onSyncFailFunc  OnSyncFailFunc
+		onSyncIdleFunc  OnSyncIdleFunc
+		onMailEvictFunc OnMailEvictFunc
+		// 邮件历史存储，nil不记录
+		mailHistorySink MailHistorySink
+		// 新邮件的ID格式
+		mailIdLayout MailIdLayout
 	}
 	xFuncOption struct {
 		f func(o *xOptions)
@@ -33,9 +50,10 @@ type (
 	}
 )
 
-func (x *xOptions) mapKey(key string) (_, _, _ string) {
-	if x.keyMappingFunc != nil {
-		return x.keyMappingFunc(key)
+// nil时使用默认映射规则
+func (f KeyMappingFunc) mapKey(key string) (_, _, _ string) {
+	if f != nil {
+		return f(key)
 	}
 	// default policy
 	a := strings.SplitN(key, ":", 3)
@@ -49,6 +67,34 @@ func (x *xOptions) mapKey(key string) (_, _, _ string) {
 	}
 }
 
+// 已回写数据的过期时长，优先级: 调用指定 > 策略函数 > 默认值
+func (x *xOptions) getTTL(key string, ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+	if x.ttlPolicyFunc != nil {
+		if ttl = x.ttlPolicyFunc(key); ttl > 0 {
+			return ttl
+		}
+	}
+	return x.ttl
+}
+
+// redmon_load/redmon_sync expiration argument
+func (x *xOptions) ttlArgs(key string, ttl time.Duration) []any {
+	if ttl = x.getTTL(key, ttl); ttl <= 0 {
+		return nil
+	}
+	return []any{ttlSeconds(ttl)}
+}
+
+func ttlSeconds(ttl time.Duration) int64 {
+	if ttl < time.Second {
+		return 1
+	}
+	return int64(ttl / time.Second)
+}
+
 func (x *xOptions) onSyncSave(key string) time.Duration {
 	if x.onSyncSaveFunc != nil {
 		return x.onSyncSaveFunc(key)
@@ -56,6 +102,13 @@ func (x *xOptions) onSyncSave(key string) time.Duration {
 	return 0
 }
 
+func (x *xOptions) onSyncStale(key string, rev int64) time.Duration {
+	if x.onSyncStaleFunc != nil {
+		return x.onSyncStaleFunc(key, rev)
+	}
+	return 0
+}
+
 func (x *xOptions) onSyncFail(err error) time.Duration {
 	if x.onSyncFailFunc != nil {
 		return x.onSyncFailFunc(err)
@@ -70,26 +123,93 @@ func (x xOptions) onSyncIdle() time.Duration {
 	return time.Second
 }
 
+func (x *xOptions) onMailEvict(key string, evicted []*Mail) {
+	if x.onMailEvictFunc != nil && len(evicted) > 0 {
+		x.onMailEvictFunc(key, evicted)
+	}
+}
+
+// redmon_mb_* arguments, prefixed with history flag and id layout
+func (x *xOptions) mbArgs(args ...any) []any {
+	flag := ""
+	if x.mailHistorySink != nil {
+		flag = "1"
+	}
+	return append([]any{flag, int(x.mailIdLayout)}, args...)
+}
+
 func (x xFuncOption) apply(o *xOptions) { x.f(o) }
 
-func WithKeyMap(f KeyMappingFunc) Option {
-	return xFuncOption{func(o *xOptions) { o.keyMappingFunc = f }}
+func WithTTL(d time.Duration) Option {
+	return xFuncOption{func(o *xOptions) { o.ttl = d }}
+}
+func WithTTLPolicy(f TTLPolicyFunc) Option {
+	return xFuncOption{func(o *xOptions) { o.ttlPolicyFunc = f }}
 }
 func OnSyncSave(f OnSyncSaveFunc) Option {
 	return xFuncOption{func(o *xOptions) { o.onSyncSaveFunc = f }}
 }
+func OnSyncStale(f OnSyncStaleFunc) Option {
+	return xFuncOption{func(o *xOptions) { o.onSyncStaleFunc = f }}
+}
 func OnSyncFail(f OnSyncFailFunc) Option {
 	return xFuncOption{func(o *xOptions) { o.onSyncFailFunc = f }}
 }
 func OnSyncIdle(f OnSyncIdleFunc) Option {
 	return xFuncOption{func(o *xOptions) { o.onSyncIdleFunc = f }}
 }
+func OnMailEvict(f OnMailEvictFunc) Option {
+	return xFuncOption{func(o *xOptions) { o.onMailEvictFunc = f }}
+}
+func WithMailHistory(sink MailHistorySink) Option {
+	return xFuncOption{func(o *xOptions) { o.mailHistorySink = sink }}
+}
+func WithMailIdLayout(layout MailIdLayout) Option {
+	return xFuncOption{func(o *xOptions) { o.mailIdLayout = layout }}
+}
+
+// Client.Sync Options
+type (
+	xSyncOptions struct {
+		// lease duration of claimed key, enable lease mode if > 0
+		lease time.Duration
+		// number of concurrent workers in lease mode
+		workers int
+		// max number of keys claimed and saved at once in lease mode
+		batch int
+		// return when dirty queue is drained
+		drain bool
+	}
+	xSyncOptionFunc struct {
+		f func(o *xSyncOptions)
+	}
+	SyncOption interface {
+		apply(o *xSyncOptions)
+	}
+)
+
+func (f xSyncOptionFunc) apply(o *xSyncOptions) { f.f(o) }
+
+func WithLease(d time.Duration) SyncOption {
+	return xSyncOptionFunc{func(o *xSyncOptions) { o.lease = d }}
+}
+func WithWorkers(n int) SyncOption {
+	return xSyncOptionFunc{func(o *xSyncOptions) { o.workers = n }}
+}
+func WithBatch(n int) SyncOption {
+	return xSyncOptionFunc{func(o *xSyncOptions) { o.batch = n }}
+}
+func WithDrain() SyncOption {
+	return xSyncOptionFunc{func(o *xSyncOptions) { o.drain = true }}
+}
 
 // Client.Get Options
 type (
 	xGetOptions struct {
 		// add or set atomically
 		addIfNotExists *string
+		// expiration of loaded data
+		ttl time.Duration
 	}
 	xGetOptionFunc struct {
 		f func(o *xGetOptions)
@@ -101,9 +221,138 @@ type (
 
 func (f xGetOptionFunc) apply(o *xGetOptions) { f.f(o) }
 
+// redmon_get arguments
+func (x xGetOptions) args() (a []any) {
+	if x.addIfNotExists != nil {
+		a = append(a, *x.addIfNotExists)
+	}
+	return
+}
+
 func AddIfNotExists(v string) GetOption {
 	return xGetOptionFunc{func(o *xGetOptions) { o.addIfNotExists = &v }}
 }
+func WithLoadTTL(d time.Duration) GetOption {
+	return xGetOptionFunc{func(o *xGetOptions) { o.ttl = d }}
+}
+
+// Client.Set Options
+type (
+	xSetOptions struct {
+		// compare and set on revision
+		ifRev *int64
+		// expiration after synced
+		ttl time.Duration
+	}
+	xSetOptionFunc struct {
+		f func(o *xSetOptions)
+	}
+	SetOption interface {
+		apply(o *xSetOptions)
+	}
+)
+
+func (f xSetOptionFunc) apply(o *xSetOptions) { f.f(o) }
+
+// redmon_set arguments
+func (x xSetOptions) args(val string) (a []any) {
+	a = append(a, val, "")
+	if x.ifRev != nil {
+		a[1] = *x.ifRev
+	}
+	if x.ttl > 0 {
+		a = append(a, ttlSeconds(x.ttl))
+	}
+	return
+}
+
+func IfRev(rev int64) SetOption {
+	return xSetOptionFunc{func(o *xSetOptions) { o.ifRev = &rev }}
+}
+
+// 回写后的过期时长，只对本次写入生效，回写前的后续写入会清除
+func WithSyncTTL(d time.Duration) SetOption {
+	return xSetOptionFunc{func(o *xSetOptions) { o.ttl = d }}
+}
+
+// Client.Update Options
+type (
+	xUpdateOptions struct {
+		// max retries on revision mismatch, 0 for default, negative for unlimited
+		maxRetries int
+		// max backoff between retries, 0 for default
+		maxBackoff time.Duration
+	}
+	xUpdateOptionFunc struct {
+		f func(o *xUpdateOptions)
+	}
+	UpdateOption interface {
+		apply(o *xUpdateOptions)
+	}
+)
+
+func (f xUpdateOptionFunc) apply(o *xUpdateOptions) { f.f(o) }
+
+// 修订冲突时的最大重试次数，默认10次，负数不限制
+func WithMaxRetries(n int) UpdateOption {
+	return xUpdateOptionFunc{func(o *xUpdateOptions) { o.maxRetries = n }}
+}
+
+// 重试间隔从1毫秒开始加倍直到此上限，实际间隔在[间隔/2, 间隔]之间随机，默认100毫秒
+func WithMaxBackoff(d time.Duration) UpdateOption {
+	return xUpdateOptionFunc{func(o *xUpdateOptions) { o.maxBackoff = d }}
+}
+
+// Client.IncrBy Options
+type (
+	xIncrOptions struct {
+		// bounds of the new value, nil for unlimited
+		min, max *int64
+	}
+	xIncrOptionFunc struct {
+		f func(o *xIncrOptions)
+	}
+	IncrOption interface {
+		apply(o *xIncrOptions)
+	}
+)
+
+func (f xIncrOptionFunc) apply(o *xIncrOptions) { f.f(o) }
+
+// redmon_incr arguments
+func (x xIncrOptions) args(delta int64) (a []any) {
+	a = append(a, delta, "", "")
+	if x.min != nil {
+		a[1] = *x.min
+	}
+	if x.max != nil {
+		a[2] = *x.max
+	}
+	return
+}
+
+func WithMin(v int64) IncrOption {
+	return xIncrOptionFunc{func(o *xIncrOptions) { o.min = &v }}
+}
+func WithMax(v int64) IncrOption {
+	return xIncrOptionFunc{func(o *xIncrOptions) { o.max = &v }}
+}
+
+// 邮箱满时的淘汰策略
+type EvictStrategy int
+
+const (
+	// 拒绝插入，返回ErrMailBoxFull
+	EvictNone EvictStrategy = iota
+	// 淘汰最不重要且最早的，当前插入的邮件可能被立即淘汰掉
+	EvictLeastImportant
+	// 同EvictLeastImportant，但当前插入的邮件会被淘汰时拒绝插入
+	EvictLessImportant
+	// 淘汰最早的，不考虑重要度
+	EvictOldest
+	// 淘汰除当前插入邮件外最新的，不考虑重要度
+	EvictNewest
+)
 
 // Client.Push Options
 type (
@@ -113,7 +362,13 @@ type (
 		// capacity of set [1,65535]
 		capacity uint16
 		// strategy on full
-		strategy int
+		strategy EvictStrategy
+		// expire at unix milliseconds, 0 for never
+		expireAt int64
+		// visible at unix milliseconds, 0 for immediately
+		visibleAt int64
+		// idempotency key
+		dedupKey string
 	}
 	xPushOptionFunc struct {
 		f func(o *xPushOptions)
@@ -125,6 +380,11 @@ type (
 
 func (f xPushOptionFunc) apply(o *xPushOptions) { f.f(o) }
 
+// redmon_mb_push arguments
+func (x xPushOptions) args(val string) []any {
+	return []any{val, x.importance, x.capacity, int(x.strategy), x.expireAt, x.visibleAt, x.dedupKey}
+}
+
 func WithImportance(v uint8) PushOption {
 	return xPushOptionFunc{func(o *xPushOptions) { o.importance = v }}
 }
@@ -132,5 +392,127 @@ func WithCapacity(v uint16) PushOption {
 	return xPushOptionFunc{func(o *xPushOptions) { o.capacity = v }}
 }
 func WithRing() PushOption {
-	return xPushOptionFunc{func(o *xPushOptions) { o.strategy = 1 }}
+	return WithEviction(EvictLeastImportant)
+}
+func WithEviction(s EvictStrategy) PushOption {
+	return xPushOptionFunc{func(o *xPushOptions) { o.strategy = s }}
+}
+func WithExpireAt(t time.Time) PushOption {
+	return xPushOptionFunc{func(o *xPushOptions) { o.expireAt = t.UnixMilli() }}
+}
+func WithVisibleAt(t time.Time) PushOption {
+	return xPushOptionFunc{func(o *xPushOptions) { o.visibleAt = t.UnixMilli() }}
+}
+func WithDedupKey(k string) PushOption {
+	return xPushOptionFunc{func(o *xPushOptions) { o.dedupKey = k }}
+}
+
+// Client.List Options
+type (
+	xListOptions struct {
+		// skip first n matched mails
+		offset int
+		// max number of mails returned, 0 for unlimited
+		limit int
+		// only mails listed after the mail with this id, default layout only
+		afterId int64
+		// only mails listed after (importance, seq)
+		afterImp uint8
+		afterSeq int64
+		// only mails with importance not less than it
+		minImportance uint8
+		// broadcast channels merged into list
+		channels []string
+		// only mails with all these flags set
+		flags uint32
+		// only mails with none of these flags set
+		noFlags uint32
+	}
+	xListOptionFunc struct {
+		f func(o *xListOptions)
+	}
+	ListOption interface {
+		apply(o *xListOptions)
+	}
+)
+
+func (f xListOptionFunc) apply(o *xListOptions) { f.f(o) }
+
+// redmon_mb_list arguments
+func (x xListOptions) args() []any {
+	return []any{x.offset, x.limit, x.afterImp, x.afterSeq, x.minImportance, x.flags, x.noFlags}
+}
+
+// WithAfter的ID只有默认格式才能解析出(重要度，序号)
+func (x xListOptions) check(layout MailIdLayout) error {
+	if x.afterId != 0 && layout != MailIdImportance {
+		return ErrBadCursor
+	}
+	return nil
+}
+
+func WithOffset(n int) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.offset = n }}
+}
+func WithLimit(n int) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.limit = n }}
+}
+
+// 只返回排在此ID的邮件之后的邮件，只适用于MailIdImportance格式，其他格式使用WithAfterMail
+func WithAfter(id int64) ListOption {
+	return xListOptionFunc{func(o *xListOptions) {
+		o.afterId, o.afterImp, o.afterSeq = id, uint8(id/1e10), id%1e10
+	}}
+}
+
+// 只返回排在此邮件之后的邮件，适用于所有ID格式
+func WithAfterMail(m *Mail) ListOption {
+	return xListOptionFunc{func(o *xListOptions) {
+		o.afterId, o.afterImp, o.afterSeq = 0, m.GetImportance(), m.Seq
+		if m.Seq == 0 {
+			o.afterSeq = m.Id % 1e10
+		}
+	}}
+}
+func WithMinImportance(v uint8) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.minImportance = v }}
+}
+func WithFlags(flags uint32) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.flags |= flags }}
+}
+func WithoutFlags(flags uint32) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.noFlags |= flags }}
+}
+
+// 同时返回这些广播频道中尚未接收的邮件，只在第一页返回，参见Client.List
+func WithBroadcast(channels ...string) ListOption {
+	return xListOptionFunc{func(o *xListOptions) { o.channels = append(o.channels, channels...) }}
+}
+
+// Client.Pop Options
+type (
+	xPopOptions struct {
+		// pop the least important mails first
+		lowest bool
+	}
+	xPopOptionFunc struct {
+		f func(o *xPopOptions)
+	}
+	PopOption interface {
+		apply(o *xPopOptions)
+	}
+)
+
+func (f xPopOptionFunc) apply(o *xPopOptions) { f.f(o) }
+
+// redmon_mb_pop arguments
+func (x xPopOptions) args(n int) []any {
+	if x.lowest {
+		return []any{n, 1}
+	}
+	return []any{n, 0}
+}
+
+func WithLowest() PopOption {
+	return xPopOptionFunc{func(o *xPopOptions) { o.lowest = true }}
 }
@@ -0,0 +1,167 @@
+-- 纯lua实现的cmsgpack，miniredis的lua环境没有提供cmsgpack库
+local cmsgpack = (function()
+    local char, byte, floor = string.char, string.byte, math.floor
+    local function be(n, w)
+        local t = {}
+        for i = w, 1, -1 do t[i] = char(n % 256); n = floor(n / 256) end
+        return table.concat(t)
+    end
+    local function isarray(t)
+        local n = 0
+        for k in pairs(t) do
+            if type(k) ~= "number" or k < 1 or floor(k) ~= k then return false end
+            n = n + 1
+        end
+        for i = 1, n do if t[i] == nil then return false end end
+        return true, n
+    end
+    local pack
+    local function double(x)
+        if x ~= x then return char(0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0) end
+        local sign = 0
+        if x < 0 or 1/x < 0 then sign = 1; x = -x end
+        if x == math.huge then return char(0xcb, sign * 128 + 0x7f, 0xf0, 0, 0, 0, 0, 0, 0) end
+        if x == 0 then return char(0xcb, sign * 128, 0, 0, 0, 0, 0, 0, 0) end
+        local m, e = math.frexp(x)
+        e = e + 1022
+        if e <= 0 then m = math.ldexp(m, e - 1); e = 0 else m = (m * 2 - 1) end
+        m = m * 2^52
+        local hi = floor(m / 2^32)
+        local lo = m - hi * 2^32
+        return char(0xcb) .. be(sign * 2^31 + e * 2^20 + hi, 4) .. be(lo, 4)
+    end
+    pack = function(v)
+        local t = type(v)
+        if t == "nil" then return char(0xc0)
+        elseif t == "boolean" then return char(v and 0xc3 or 0xc2)
+        elseif t == "number" then
+            if floor(v) ~= v or v ~= v or v == math.huge or v == -math.huge then return double(v) end
+            if v >= 0 then
+                if v < 128 then return char(v)
+                elseif v < 2^8 then return char(0xcc) .. be(v, 1)
+                elseif v < 2^16 then return char(0xcd) .. be(v, 2)
+                elseif v < 2^32 then return char(0xce) .. be(v, 4)
+                else return char(0xcf) .. be(v, 8) end
+            else
+                if v >= -32 then return char(256 + v)
+                elseif v >= -2^7 then return char(0xd0) .. be(2^8 + v, 1)
+                elseif v >= -2^15 then return char(0xd1) .. be(2^16 + v, 2)
+                elseif v >= -2^31 then return char(0xd2) .. be(2^32 + v, 4)
+                else return char(0xd3) .. be(2^64 + v, 8) end
+            end
+        elseif t == "string" then
+            local n = #v
+            if n < 32 then return char(0xa0 + n) .. v
+            elseif n < 2^8 then return char(0xd9) .. be(n, 1) .. v
+            elseif n < 2^16 then return char(0xda) .. be(n, 2) .. v
+            else return char(0xdb) .. be(n, 4) .. v end
+        elseif t == "table" then
+            local buf = {}
+            local a, n = isarray(v)
+            if a then
+                if n < 16 then buf[1] = char(0x90 + n)
+                elseif n < 2^16 then buf[1] = char(0xdc) .. be(n, 2)
+                else buf[1] = char(0xdd) .. be(n, 4) end
+                for i = 1, n do buf[#buf+1] = pack(v[i]) end
+            else
+                n = 0
+                for k, x in pairs(v) do
+                    n = n + 1
+                    buf[#buf+1] = pack(k)
+                    buf[#buf+1] = pack(x)
+                end
+                if n < 16 then table.insert(buf, 1, char(0x80 + n))
+                elseif n < 2^16 then table.insert(buf, 1, char(0xde) .. be(n, 2))
+                else table.insert(buf, 1, char(0xdf) .. be(n, 4)) end
+            end
+            return table.concat(buf)
+        end
+        error("cmsgpack: unsupported type " .. t)
+    end
+    local function unpack(s)
+        local pos = 1
+        local function u(w)
+            local n = 0
+            for i = pos, pos + w - 1 do n = n * 256 + byte(s, i) end
+            pos = pos + w
+            return n
+        end
+        local function i(w)
+            local n = u(w)
+            if n >= 2^(8*w-1) then n = n - 2^(8*w) end
+            return n
+        end
+        local function str(n)
+            local r = s:sub(pos, pos + n - 1)
+            pos = pos + n
+            return r
+        end
+        local decode
+        local function arr(n)
+            local t = {}
+            for k = 1, n do t[k] = decode() end
+            return t
+        end
+        local function map(n)
+            local t = {}
+            for _ = 1, n do
+                local k = decode()
+                t[k] = decode()
+            end
+            return t
+        end
+        local function f64()
+            local hi, lo = u(4), u(4)
+            local sign = hi >= 2^31 and -1 or 1
+            if hi >= 2^31 then hi = hi - 2^31 end
+            local e = floor(hi / 2^20)
+            local m = (hi % 2^20) * 2^32 + lo
+            if e == 0 then return sign * math.ldexp(m, -1074) end
+            if e == 2047 then return m == 0 and sign * math.huge or 0/0 end
+            return sign * math.ldexp(m + 2^52, e - 1075)
+        end
+        local function f32()
+            local n = u(4)
+            local sign = n >= 2^31 and -1 or 1
+            if n >= 2^31 then n = n - 2^31 end
+            local e = floor(n / 2^23)
+            local m = n % 2^23
+            if e == 0 then return sign * math.ldexp(m, -149) end
+            if e == 255 then return m == 0 and sign * math.huge or 0/0 end
+            return sign * math.ldexp(m + 2^23, e - 150)
+        end
+        decode = function()
+            local c = byte(s, pos)
+            pos = pos + 1
+            if c < 0x80 then return c
+            elseif c < 0x90 then return map(c - 0x80)
+            elseif c < 0xa0 then return arr(c - 0x90)
+            elseif c < 0xc0 then return str(c - 0xa0)
+            elseif c == 0xc0 then return nil
+            elseif c == 0xc2 then return false
+            elseif c == 0xc3 then return true
+            elseif c == 0xc4 or c == 0xd9 then return str(u(1))
+            elseif c == 0xc5 or c == 0xda then return str(u(2))
+            elseif c == 0xc6 or c == 0xdb then return str(u(4))
+            elseif c == 0xca then return f32()
+            elseif c == 0xcb then return f64()
+            elseif c == 0xcc then return u(1)
+            elseif c == 0xcd then return u(2)
+            elseif c == 0xce then return u(4)
+            elseif c == 0xcf then return u(8)
+            elseif c == 0xd0 then return i(1)
+            elseif c == 0xd1 then return i(2)
+            elseif c == 0xd2 then return i(4)
+            elseif c == 0xd3 then return i(8)
+            elseif c == 0xdc then return arr(u(2))
+            elseif c == 0xdd then return arr(u(4))
+            elseif c == 0xde then return map(u(2))
+            elseif c == 0xdf then return map(u(4))
+            elseif c >= 0xe0 then return c - 256
+            end
+            error("cmsgpack: unsupported format " .. c)
+        end
+        return decode()
+    end
+    return { pack = pack, unpack = unpack }
+end)()
@@ -0,0 +1,81 @@
+// 用于测试的内存REDIS，不依赖外部服务即可运行redmon的lua脚本
+package redmontest
+
+import (
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/ntons/redis"
+)
+
+// 脚本前置的cmsgpack实现
+//
+//go:embed msgpack.lua
+var prelude string
+
+// 启动内存REDIS并返回连接它的客户端，测试结束时自动关闭
+// 所有脚本执行前都会注入cmsgpack实现，SCRIPT LOAD/EVALSHA由本地缓存模拟
+func NewRedis(tb testing.TB) (redis.Client, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		tb.Fatal("failed to run miniredis:", err)
+	}
+	var (
+		mu      sync.Mutex
+		scripts = make(map[string]string)
+	)
+	srv := m.Server()
+	srv.SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		switch strings.ToUpper(cmd) {
+		case "SCRIPT":
+			if len(args) == 2 && strings.ToUpper(args[0]) == "LOAD" {
+				h := sha1.Sum([]byte(args[1]))
+				sha := hex.EncodeToString(h[:])
+				mu.Lock()
+				scripts[sha] = args[1]
+				mu.Unlock()
+				c.WriteBulk(sha)
+				return true
+			}
+		case "EVALSHA":
+			if len(args) == 0 {
+				return false
+			}
+			mu.Lock()
+			src, ok := scripts[strings.ToLower(args[0])]
+			mu.Unlock()
+			if !ok {
+				c.WriteError("NOSCRIPT No matching script. Please use EVAL.")
+				return true
+			}
+			srv.Dispatch(c, append([]string{"EVAL", prelude + src}, args[1:]...))
+			return true
+		case "EVAL":
+			if len(args) > 0 && !strings.HasPrefix(args[0], prelude) {
+				srv.Dispatch(c, append([]string{"EVAL", prelude + args[0]}, args[1:]...))
+				return true
+			}
+		}
+		return false
+	})
+	r, err := redis.Dial(context.Background(), "redis://"+m.Addr())
+	if err != nil {
+		m.Close()
+		tb.Fatal("failed to dial miniredis:", err)
+	}
+	tb.Cleanup(func() {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+		m.Close()
+	})
+	return r, m
+}
@@ -51,7 +51,7 @@ func Dial() {
 	mdb.Connect(ctx)
 	mdb.Database("redmon").Drop(ctx)
 
-	cli = redmon.NewClient(rdb, mdb)
+	cli = redmon.NewClient(rdb, redmon.NewMongoStore(mdb, nil))
 }
 
 func RandPayload() string {
@@ -19,6 +19,31 @@ local function binarysearch(a, f)
     return i
 end
 
+-- 位运算，lua 5.1没有位运算符，不依赖bit库
+-- f(x, y) 由两个操作数对应位的值决定结果位的值
+local function bitop(a, b, f)
+    local r, m = 0, 1
+    while a > 0 or b > 0 do
+        if f(a % 2, b % 2) then r = r + m end
+        a, b, m = math.floor(a / 2), math.floor(b / 2), m * 2
+    end
+    return r
+end
+local function band(a, b) return bitop(a, b, function(x, y) return x == 1 and y == 1 end) end
+local function bor(a, b) return bitop(a, b, function(x, y) return x == 1 or y == 1 end) end
+local function bclr(a, b) return bitop(a, b, function(x, y) return x == 1 and y == 0 end) end
+
+-- 当前时间(毫秒)
+local function redmon_now()
+    local t = redis.call("TIME")
+    return t[1] * 1000 + math.floor(t[2] / 1000)
+end
+
+-- 邮件是否可见(已到可见时间且未过期)
+local function redmon_mb_visible(m, now)
+    return (not m.vis or m.vis <= now) and (not m.exp or m.exp > now)
+end
+
 -- 已回写数据的默认过期时长
 local DEFAULT_EX = 86400
 
@@ -26,10 +51,49 @@ local DEFAULT_EX = 86400
 local DIRTY_SET = "$DIRTYSET$"
 local DIRTY_QUE = "$DIRTYQUE$"
 
+-- 租约回写标记，被领取的脏KEY从QUE移入LEASE(到期时间)并记录OWNER(回写者)
+-- 脏KEY始终只在QUE或LEASE中的一处，租约到期的KEY重新进入QUE
+local DIRTY_LEASE = "$DIRTYLEASE$"
+local DIRTY_OWNER = "$DIRTYOWNER$"
+
+-- 邮件历史，被删除的邮件先进入此队列，由回写过程写入历史存储
+-- 被领取的邮件历史移入"$MAILHIS$:领取者"队列，LEASE记录领取者的到期时间，确认写入后删除，
+-- 租约到期的重新入队
+local MAIL_HISTORY = "$MAILHIS$"
+local MAIL_HISTORY_LEASE = "$MAILHISLEASE$"
+
+-- 当前邮箱调用是否记录邮件历史
+local mb_history = false
+
+-- 当前邮箱调用保存后的修订，随邮件历史记录，删除后重建的邮箱ID可能重复，但修订不会
+local mb_rev = 0
+
+-- 当前邮箱调用生成新邮件ID的格式
+local mb_layout = 0
+
+-- 当前写入指定的回写后过期时长，只有redmon_set可以指定
+local save_ex = nil
+
 -- 保存数据，同时标记脏KEY
-local function redmon_save(k, d, v)
-    d.rev = d.rev + 1
-    if v then d.val = v end
+-- 写入新值的同时清除删除标记(墓碑)
+-- 回写后的过期时长只由最后一次写入决定，未指定的写入清除之前指定的
+-- hch 哈希数据修改的字段列表，累积到d.hch直到回写，回写时只需写入这些字段；
+--     d.hfull表示需要整体回写；nil表示写入的不是哈希数据
+local function redmon_save(k, d, v, hch)
+    d.rev, d.ex = d.rev + 1, save_ex
+    if v then d.val = v; d.del = nil end
+    if not hch then
+        d.hsh, d.hch, d.hfull = nil, nil, nil
+    elseif d.hfull then
+        d.hsh = true
+    else
+        d.hsh, d.hch = true, d.hch or {}
+        local a = {}
+        for _, f in ipairs(d.hch) do a[f] = true end
+        for _, f in ipairs(hch) do
+            if not a[f] then a[f] = true; d.hch[#d.hch+1] = f end
+        end
+    end
     local b = cmsgpack.pack(d)
     redis.call("SET", k, b)
     if redis.call("SADD", DIRTY_SET, k) > 0 then
@@ -38,6 +102,16 @@ local function redmon_save(k, d, v)
     return b
 end
 
+-- 已回写，清除脏标记和哈希字段修改记录，然后设置过期时长
+local function redmon_synced(k, d, ex)
+    redis.call("SREM", DIRTY_SET, k)
+    if d.hch or d.hfull then
+        d.hch, d.hfull = nil, nil
+        redis.call("SET", k, cmsgpack.pack(d))
+    end
+    redis.call("EXPIRE", k, tonumber(d.ex or ex or DEFAULT_EX))
+end
+
 -- 加载数据
 -- ARGV[1] 数据
 -- ARGV[2] 过期时长，默认: 86400
@@ -58,7 +132,7 @@ local function redmon_get()
     if not b then return nil end
     if ARGV[1] then
         local d = cmsgpack.unpack(b)
-        if d.rev == 0 then
+        if d.rev == 0 or d.del then
             b = redmon_save(KEYS[1], d, ARGV[1])
         end
     end
@@ -67,11 +141,15 @@ end
 
 -- 修改数据，不管存在与否
 -- ARGV[1] 数据
--- RET nil为加载数据 or 当前修订
+-- ARGV[2] 期望的当前修订(CompareAndSet)，空串不比较
+-- ARGV[3] 可选，回写后的过期时长，随数据保存，覆盖回写时指定的过期时长
+-- RET nil为加载数据 or 当前修订 or -1-当前修订(修订不匹配)
 local function redmon_set()
     local b = redis.call("GET", KEYS[1])
     if not b then return nil end
     local d = cmsgpack.unpack(b)
+    if ARGV[2] and ARGV[2] ~= "" and tostring(d.rev) ~= ARGV[2] then return -1 - d.rev end
+    save_ex = ARGV[3] and tonumber(ARGV[3])
     redmon_save(KEYS[1], d, ARGV[1])
     return d.rev
 end
@@ -83,22 +161,193 @@ local function redmon_add()
     local b = redis.call("GET",KEYS[1])
     if not b then return nil end
     local d = cmsgpack.unpack(b)
-    if d.rev ~= 0 then return 0 end
+    if d.rev ~= 0 and not d.del then return 0 end
     redmon_save(KEYS[1], d, ARGV[1])
     return d.rev
 end
 
--- 包装邮箱处理方法
--- ARGV 由实际处理方法定义
+-- 删除数据，写入墓碑修订，由回写过程同步到DB
+-- RET nil未加载数据 or 0数据不存在 or 墓碑修订
+local function redmon_del()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    if d.rev == 0 or d.del then return 0 end
+    d.val, d.del = "", true
+    redmon_save(KEYS[1], d)
+    return d.rev
+end
+
+-- 解码哈希数据，哈希数据是字段到值的msgpack map，空哈希保存为空串
+-- RET nil数据不存在 or false不是哈希数据 or 字段表
+local function redmon_hash(d)
+    if d.rev == 0 or d.del then return nil end
+    if not d.hsh then return false end
+    if #d.val == 0 then return {} end
+    return cmsgpack.unpack(d.val)
+end
+
+-- 编码哈希数据，cmsgpack会把空表编码为数组，所以空哈希编码为空串
+local function redmon_hash_pack(h)
+    if next(h) == nil then return "" end
+    return cmsgpack.pack(h)
+end
+
+-- 获取哈希字段
+-- ARGV[1] 字段
+-- RET nil未加载数据 or 0数据不存在 or -1不是哈希数据 or {当前修订，字段值} or {当前修订}字段不存在
+local function redmon_hget()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local h = redmon_hash(d)
+    if h == nil then return 0 elseif h == false then return -1 end
+    return { d.rev, h[ARGV[1]] }
+end
+
+-- 获取全部哈希字段
+-- RET nil未加载数据 or 0数据不存在 or -1不是哈希数据 or {当前修订，哈希数据}
+local function redmon_hgetall()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local h = redmon_hash(d)
+    if h == nil then return 0 elseif h == false then return -1 end
+    return { d.rev, d.val }
+end
+
+-- 设置哈希字段，数据不存在时创建哈希数据，需要整体回写
+-- ARGV 字段1，值1，字段2，值2...
+-- RET nil未加载数据 or -1不是哈希数据 or 新修订
+local function redmon_hset()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local h = redmon_hash(d)
+    if h == false then return -1 end
+    if h == nil then h, d.hch, d.hfull = {}, nil, true end
+    local hch = {}
+    for i = 1, #ARGV, 2 do
+        h[ARGV[i]] = ARGV[i+1]
+        hch[#hch+1] = ARGV[i]
+    end
+    redmon_save(KEYS[1], d, redmon_hash_pack(h), hch)
+    return d.rev
+end
+
+-- 删除哈希字段，删除全部字段后保留空哈希
+-- ARGV 字段列表
+-- RET nil未加载数据 or -1不是哈希数据 or 删除的字段数量
+local function redmon_hdel()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local h = redmon_hash(d)
+    if h == nil then return 0 elseif h == false then return -1 end
+    local hch = {}
+    for _, f in ipairs(ARGV) do
+        if h[f] ~= nil then
+            h[f] = nil
+            hch[#hch+1] = f
+        end
+    end
+    if #hch > 0 then redmon_save(KEYS[1], d, redmon_hash_pack(h), hch) end
+    return #hch
+end
+
+-- 计数，数据为十进制整数，不存在视为0，在lua中以double运算，绝对值不应超过2^53
+-- ARGV[1] 增量
+-- ARGV[2] 下限，空串不限制
+-- ARGV[3] 上限，空串不限制
+-- RET nil未加载数据 or {1，新值，新修订} or {0，当前值，当前修订}越界 or {-1，0，当前修订}不是整数
+local function redmon_incr()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local v = 0
+    if d.hsh then return { -1, 0, d.rev } end
+    if d.rev ~= 0 and not d.del and d.val ~= "" then
+        v = tonumber(d.val)
+        if not v or math.floor(v) ~= v then return { -1, 0, d.rev } end
+    end
+    local n = v + tonumber(ARGV[1])
+    local min, max = tonumber(ARGV[2] or ""), tonumber(ARGV[3] or "")
+    if (min and n < min) or (max and n > max) then return { 0, v, d.rev } end
+    redmon_save(KEYS[1], d, string.format("%.0f", n))
+    return { 1, n, d.rev }
+end
+
+-- 记录被删除的邮件
+-- why 删除原因: pull, pop, evict, expire
+local function redmon_mb_removed(m, why, now)
+    if not mb_history then return end
+    redis.call("LPUSH", MAIL_HISTORY, cmsgpack.pack({ key=KEYS[1], rev=mb_rev, id=m.id, val=m.val, why=why, at=now }))
+end
+
+-- 解码邮箱
+-- 邮件按(重要度，序号)升序排列，旧版邮件没有重要度和序号字段，ID即重要度*1e10+序号，解码时补全，
+-- 邮箱被修改时随之保存，从而完成迁移
+local function redmon_mb_unpack(s)
+    local mb = cmsgpack.unpack(s)
+    for _, m in ipairs(mb.que) do
+        if (m.seq or 0) == 0 then m.imp, m.seq = math.floor(m.id / 1e10), m.id % 1e10 end
+    end
+    return mb
+end
+
+-- 邮件a是否排在邮件b之前
+local function redmon_mb_before(a, b)
+    return a.imp < b.imp or (a.imp == b.imp and a.seq < b.seq)
+end
+
+-- 按排列顺序插入邮件
+local function redmon_mb_insert(mb, m)
+    table.insert(mb.que, binarysearch(mb.que, function(x) return redmon_mb_before(m, x) end), m)
+end
+
+-- 生成邮件序号和ID，ID格式由mb_layout决定
+--   0 重要度*1e10+序号，兼容旧版
+--   1 序号
+--   2 毫秒时间*1000+毫秒内序号，单调递增
+local function redmon_mb_newid(mb, imp, now)
+    mb.seq = mb.seq + 1
+    if mb_layout == 1 then
+        return mb.seq, mb.seq
+    elseif mb_layout == 2 then
+        mb.tid = math.max(now * 1000, (mb.tid or 0) + 1)
+        return mb.seq, mb.tid
+    end
+    return mb.seq, imp * 1e10 + mb.seq
+end
+
+-- 包装邮箱处理方法，处理前清除已过期的邮件
+-- 处理方法可以额外返回true表示邮箱未修改，此时如果也没有清除过期邮件则不保存，不增加版本也不标记为脏
+-- ARGV[1] 是否记录邮件历史，"1"记录
+-- ARGV[2] 新邮件的ID格式，参见redmon_mb_newid
+-- ARGV[3...] 由实际处理方法定义
 -- RET nil数据未加载 or 实际处理方法返回
 local function redmon_mb_call(f)
+    mb_history, mb_layout = ARGV[1] == "1", tonumber(ARGV[2] or 0)
+    if mb_layout < 0 or mb_layout > 2 then error("bad id layout") end
+    table.remove(ARGV, 1)
+    table.remove(ARGV, 1)
     local b = redis.call("GET", KEYS[1])
     if not b then return nil end
     local d = cmsgpack.unpack(b)
     local mb = { seq=0, que={} }
-    if #d.val > 0 then mb = cmsgpack.unpack(d.val) end
-    local r = f(mb)
-    redmon_save(KEYS[1], d, cmsgpack.pack(mb))
+    if #d.val > 0 then mb = redmon_mb_unpack(d.val) end
+    mb_rev = d.rev + 1
+    local now = redmon_now()
+    local purged = false
+    for i = #mb.que, 1, -1 do
+        local exp = mb.que[i].exp
+        if exp and exp <= now then
+            redmon_mb_removed(table.remove(mb.que, i), "expire", now)
+            purged = true
+        end
+    end
+    local r, unchanged = f(mb, now)
+    if purged or not unchanged then redmon_save(KEYS[1], d, cmsgpack.pack(mb)) end
     return r
 end
 
@@ -106,50 +355,264 @@ end
 -- ARGV[1] 邮件数据
 -- ARGV[2] 邮件重要度
 -- ARGV[3] 邮箱容量
--- ARGV[4] 淘汰策略，目前只有1，删除最不重要且最早的，淘汰发生在插入后，当前插入的邮件可能被立即淘汰掉
--- RET 进入队列的邮件ID
-local function redmon_mb_push(mb)
+-- ARGV[4] 邮箱满时的淘汰策略
+--   0 拒绝插入
+--   1 删除最不重要且最早的，当前插入的邮件可能被立即淘汰掉
+--   2 同1，但当前插入的邮件会被淘汰时拒绝插入
+--   3 删除最早的，不考虑重要度
+--   4 删除除当前插入邮件外最新的，不考虑重要度
+-- ARGV[5] 可选，过期时间(毫秒)，0不过期
+-- ARGV[6] 可选，可见时间(毫秒)，0立即可见
+-- ARGV[7] 可选，去重键，邮箱中已有相同去重键的邮件时不再插入，返回已有邮件ID
+-- RET {-1}拒绝插入 or {进入队列的邮件ID，被淘汰的邮件列表}
+local function redmon_mb_push(mb, now)
+    local evicted = {}
+    -- 去重
+    local dup = ARGV[7] or ""
+    if dup ~= "" then
+        for _, m in ipairs(mb.que) do
+            if m.dup == dup then return { m.id, cmsgpack.pack(evicted) }, true end
+        end
+    end
+    local cap, strategy = tonumber(ARGV[3] or 0), tonumber(ARGV[4] or 0)
+    if not cap then error("bad capacity") end
+    if strategy < 0 or strategy > 4 then error("bad strategy") end
+    -- 需要淘汰的数量
+    local n = 0
+    if cap > 0 then n = math.max(#mb.que + 1 - cap, 0) end
+    local m = { imp=tonumber(ARGV[2] or 0), seq=mb.seq + 1, val=ARGV[1] }
+    if n > 0 and (strategy == 0 or (strategy == 2 and
+        binarysearch(mb.que, function(x) return redmon_mb_before(m, x) end) <= n)) then
+        return { -1 }, true
+    end
     -- 插入
-    mb.seq = mb.seq + 1
-    local id = tonumber(ARGV[2] or 0) * 1e10 + mb.seq
-    local i = binarysearch(mb.que, function(m) return m.id > id end)
-    table.insert(mb.que, i, { id=id, val=ARGV[1] })
+    m.seq, m.id = redmon_mb_newid(mb, m.imp, now)
+    local exp, vis = tonumber(ARGV[5] or 0), tonumber(ARGV[6] or 0)
+    if exp > 0 then m.exp = exp end
+    if vis > 0 then m.vis = vis end
+    if dup ~= "" then m.dup = dup end
+    redmon_mb_insert(mb, m)
     -- 淘汰
-    local cap = tonumber(ARGV[3] or 0)
-    if not cap then error("bad capacity") end
-    if cap > 0 and #mb.que > cap then
-        if tonumber(ARGV[4] or 0) == 1 then
-            while #mb.que > cap do table.remove(mb.que, 1) end
-        else
-            return -1
+    for _ = 1, n do
+        local j = 1
+        if strategy == 3 or strategy == 4 then
+            -- 序号越小越早
+            local seq
+            for k, v in ipairs(mb.que) do
+                if strategy == 3 and (not seq or v.seq < seq) then
+                    j, seq = k, v.seq
+                elseif strategy == 4 and v ~= m and (not seq or v.seq > seq) then
+                    j, seq = k, v.seq
+                end
+            end
         end
+        evicted[#evicted+1] = table.remove(mb.que, j)
+        redmon_mb_removed(evicted[#evicted], "evict", now)
     end
-    return id
+    return { m.id, cmsgpack.pack(evicted) }
 end
 
 -- 删除邮件
 -- ARGV 待删除邮件ID列表
 -- RET 被成功删除的邮件ID列表(其他的ID不存在)
-local function redmon_mb_pull(mb)
+local function redmon_mb_pull(mb, now)
+    local ids, r = {}, {}
+    for _, v in ipairs(ARGV) do ids[tonumber(v)] = true end
+    for i = #mb.que, 1, -1 do
+        if ids[mb.que[i].id] then
+            ids[mb.que[i].id] = nil
+            local m = table.remove(mb.que, i)
+            table.insert(r, 1, m.id)
+            redmon_mb_removed(m, "pull", now)
+        end
+    end
+    return r
+end
+
+-- 取出邮件，返回的同时从邮箱删除，未到可见时间的邮件不会被取出
+-- ARGV[1] 最多取出的邮件数量
+-- ARGV[2] 取出顺序，0重要度最高的优先，1重要度最低的优先，重要度相同时先进先出
+-- RET 取出的邮件列表，按取出顺序排列
+local function redmon_mb_pop(mb, now)
+    local n, r = tonumber(ARGV[1] or 1), {}
+    local lowest = tonumber(ARGV[2] or 0) == 1
+    while #r < n do
+        local i
+        if lowest then
+            for j = 1, #mb.que do
+                if redmon_mb_visible(mb.que[j], now) then i = j; break end
+            end
+        else
+            -- 重要度最高的可见邮件中最早的
+            local imp
+            for j = #mb.que, 1, -1 do
+                local k = mb.que[j].imp
+                if imp and k < imp then break end
+                if redmon_mb_visible(mb.que[j], now) then imp, i = k, j end
+            end
+        end
+        if not i then break end
+        r[#r+1] = table.remove(mb.que, i)
+        redmon_mb_removed(r[#r], "pop", now)
+    end
+    return cmsgpack.pack(r)
+end
+
+-- 广播频道中游标之后待接收的邮件
+-- 游标由连续接收的最大序号cur和其后已接收的序号列表dlv组成
+-- 按序号排列，跳过已接收、已过期和未到可见时间的邮件
+-- 同时返回接收这些邮件后的游标：cur推进到最早的未到可见时间的邮件之前，dlv只保留cur之后的序号
+-- RET nil频道未加载 or 邮件列表，新的cur，新的dlv
+local function redmon_bc_pending(k, cur, dlv, now)
+    local b = redis.call("GET", k)
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    local r = {}
+    if d.rev == 0 or d.del or #d.val == 0 then return r, cur, dlv end
+    local ch = redmon_mb_unpack(d.val)
+    local done = {}
+    for _, s in ipairs(dlv or {}) do done[s] = true end
+    local wait
+    for _, m in ipairs(ch.que) do
+        if m.seq > cur and not done[m.seq] and not (m.exp and m.exp <= now) then
+            if m.vis and m.vis > now then
+                if not wait or m.seq < wait then wait = m.seq end
+            else
+                r[#r+1] = m
+            end
+        end
+    end
+    table.sort(r, function(x, y) return x.seq < y.seq end)
+    local ncur = math.max(cur, wait and wait - 1 or ch.seq)
+    local ndlv = {}
+    for s in pairs(done) do
+        if s > ncur then ndlv[#ndlv+1] = s end
+    end
+    for _, m in ipairs(r) do
+        if m.seq > ncur then ndlv[#ndlv+1] = m.seq end
+    end
+    table.sort(ndlv)
+    if #ndlv == 0 then ndlv = nil end
+    return r, ncur, ndlv
+end
+
+-- 标记邮件
+-- ARGV[1] 设置的标记位
+-- ARGV[2] 清除的标记位
+-- ARGV[3...] 邮件ID列表
+-- RET 被标记的邮件ID列表(其他的ID不存在)
+local function redmon_mb_mark(mb)
+    local set, clr = tonumber(ARGV[1]), tonumber(ARGV[2])
+    local ids, r = {}, {}
+    for k = 3, #ARGV do ids[tonumber(ARGV[k])] = true end
+    for _, m in ipairs(mb.que) do
+        if ids[m.id] then
+            ids[m.id] = nil
+            m.flg = bclr(bor(m.flg or 0, set), clr)
+            if m.flg == 0 then m.flg = nil end
+            r[#r+1] = m.id
+        end
+    end
+    return r
+end
+
+-- 查看邮件，只读，不修改邮箱，不可见(未到可见时间或已过期)的邮件被过滤
+-- 邮件按(重要度，序号)升序排列，游标和重要度过滤可以二分定位起点
+-- KEYS[2...] 可选，广播频道，待接收的广播邮件只在第一页(没有跳过和游标)追加在邮箱邮件之后，不受数量限制
+-- ARGV[1] 跳过匹配的前n封邮件
+-- ARGV[2] 最多返回的邮件数量，0不限制
+-- ARGV[3] 游标重要度
+-- ARGV[4] 游标序号，只返回排在(游标重要度，游标序号)之后的邮件
+-- ARGV[5] 只返回重要度不小于此值的邮件
+-- ARGV[6] 只返回设置了全部这些标记位的邮件
+-- ARGV[7] 只返回没有设置任何这些标记位的邮件
+-- ARGV[8] "1"只返回匹配的邮件数量，不分页
+-- RET nil数据未加载 or 0邮箱不存在 or 邮件列表 or {邮件数量}
+local function redmon_mb_list()
+    local b = redis.call("GET", KEYS[1])
+    if not b then return nil end
+    local d = cmsgpack.unpack(b)
+    if (d.rev == 0 or d.del) and #KEYS < 2 then return 0 end
+    local r = {}
+    local mb = { seq=0, que={} }
+    if not d.del and #d.val > 0 then mb = redmon_mb_unpack(d.val) end
+    local que = mb.que
+    local offset, limit = tonumber(ARGV[1] or 0), tonumber(ARGV[2] or 0)
+    local after = { imp=tonumber(ARGV[3] or 0), seq=tonumber(ARGV[4] or 0) }
+    local imp = tonumber(ARGV[5] or 0)
+    local set, clr = tonumber(ARGV[6] or 0), tonumber(ARGV[7] or 0)
+    local count = ARGV[8] == "1"
+    if count then offset, limit = 0, 0 end
+    local first = offset == 0 and after.imp == 0 and after.seq == 0
+    local now = redmon_now()
+    local function match(m)
+        local flg = m.flg or 0
+        return redmon_mb_visible(m, now) and band(flg, set) == set and band(flg, clr) == 0
+    end
+    local i = binarysearch(que, function(m) return m.imp >= imp and redmon_mb_before(after, m) end)
+    while i <= #que and (limit <= 0 or #r < limit) do
+        if match(que[i]) then
+            if offset > 0 then offset = offset - 1 else r[#r+1] = que[i] end
+        end
+        i = i + 1
+    end
+    for j = 2, first and #KEYS or 1 do
+        local a = redmon_bc_pending(KEYS[j], mb.cur and mb.cur[KEYS[j]] or 0, mb.dlv and mb.dlv[KEYS[j]], now)
+        if not a then return nil end
+        for _, m in ipairs(a) do
+            if m.imp >= imp and match(m) then
+                m.chn = KEYS[j]
+                r[#r+1] = m
+            end
+        end
+    end
+    if count then return { #r } end
+    return cmsgpack.pack(r)
+end
+
+-- 接收广播邮件，把广播频道中游标之后的邮件复制到邮箱(保留重要度，重新分配ID)，然后推进游标
+-- KEYS[2...] 广播频道
+-- RET 复制到邮箱的邮件ID列表
+local function redmon_mb_materialize(mb, now)
     local r = {}
-    for _, v in ipairs(ARGV) do
-        local id = tonumber(v)
-        local i = binarysearch(mb.que, function(m) return m.id >= id end)
-        if i <= #mb.que and mb.que[i].id == id then
-            r[#r+1] = mb.que[i].id
-            table.remove(mb.que, i)
+    for j = 2, #KEYS do
+        local k = KEYS[j]
+        local a, cur, dlv = redmon_bc_pending(k, mb.cur and mb.cur[k] or 0, mb.dlv and mb.dlv[k], now)
+        for _, c in ipairs(a) do
+            local m = { imp=c.imp, val=c.val, exp=c.exp }
+            m.seq, m.id = redmon_mb_newid(mb, m.imp, now)
+            redmon_mb_insert(mb, m)
+            r[#r+1] = m.id
+        end
+        if cur > 0 then
+            mb.cur = mb.cur or {}
+            mb.cur[k] = cur
+        end
+        if dlv or mb.dlv then
+            mb.dlv = mb.dlv or {}
+            mb.dlv[k] = dlv
+            if next(mb.dlv) == nil then mb.dlv = nil end
         end
     end
     return r
 end
 
--- 回写数据
+-- 租约到期的KEY重新入队，优先回写
+local function redmon_sync_expired(now)
+    for _, k in ipairs(redis.call("ZRANGEBYSCORE", DIRTY_LEASE, "-inf", now, "LIMIT", 0, 100)) do
+        redis.call("ZREM", DIRTY_LEASE, k)
+        redis.call("HDEL", DIRTY_OWNER, k)
+        redis.call("RPUSH", DIRTY_QUE, k)
+    end
+end
+
+-- 回写数据，租约方式(如Flush)领取后未释放且已到期的KEY同样重新入队
 -- KEYS[1] 可选，已回写键值
 -- ARGV[1] 可选，已回写修订
 -- ARGV[2] 过期时长，默认: 86400
 -- RET {待回写键值，待回写数据}
 local function redmon_sync()
-    assert(#KEYS < 2 and #KEYS == #ARGV)
+    assert(#KEYS < 2 and #KEYS <= #ARGV)
     if #KEYS > 0 and redis.call("LINDEX", DIRTY_QUE, -1) == KEYS[1] then
         local b = redis.call("GET", KEYS[1])
         if not b then
@@ -159,13 +622,13 @@ local function redmon_sync()
             local d = cmsgpack.unpack(b)
             if tostring(d.rev) == ARGV[1] then
                 redis.call("RPOP", DIRTY_QUE)
-                redis.call("SREM", DIRTY_SET, KEYS[1])
-                redis.call("EXPIRE", KEYS[1], tonumber(ARGV[2] or DEFAULT_EX))
+                redmon_synced(KEYS[1], d, ARGV[2])
             else
                 redis.call("RPOPLPUSH", DIRTY_QUE, DIRTY_QUE)
             end
         end
     end
+    redmon_sync_expired(redmon_now())
     local k = redis.call("LINDEX", DIRTY_QUE, -1)
     if not k then return nil end
     local b = redis.call("GET", k)
@@ -177,6 +640,122 @@ local function redmon_sync()
     return {k, b}
 end
 
+-- 租约方式回写数据，多个回写者可以并行，每次可领取多个KEY
+-- KEYS 可选，已回写键值列表，租约已失效的忽略
+-- ARGV[1] 回写者标识
+-- ARGV[2] 租约时长(毫秒)
+-- ARGV[3] 最多领取KEY数量
+-- ARGV[4...] 每个已回写键值依次对应两个参数:
+--            已回写修订，空串表示回写失败，KEY重新入队
+--            过期时长，空串使用默认: 86400
+-- RET nil无待回写数据 or {待回写键值1，待回写数据1，待回写键值2，待回写数据2...}
+local function redmon_sync_lease()
+    local now = redmon_now()
+    for i, k in ipairs(KEYS) do
+        if redis.call("HGET", DIRTY_OWNER, k) == ARGV[1] then
+            redis.call("ZREM", DIRTY_LEASE, k)
+            redis.call("HDEL", DIRTY_OWNER, k)
+            local b = redis.call("GET", k)
+            if not b then
+                redis.call("SREM", DIRTY_SET, k)
+            else
+                local d = cmsgpack.unpack(b)
+                local rev, ex = ARGV[2+i*2], ARGV[3+i*2]
+                if ex == "" then ex = nil end
+                if tostring(d.rev) == rev then
+                    redmon_synced(k, d, ex)
+                else
+                    redis.call("LPUSH", DIRTY_QUE, k)
+                end
+            end
+        end
+    end
+    redmon_sync_expired(now)
+    local r = {}
+    while #r < tonumber(ARGV[3]) * 2 do
+        local k = redis.call("RPOP", DIRTY_QUE)
+        if not k then break end
+        local b = redis.call("GET", k)
+        if b then
+            redis.call("ZADD", DIRTY_LEASE, now + tonumber(ARGV[2]), k)
+            redis.call("HSET", DIRTY_OWNER, k, ARGV[1])
+            r[#r+1] = k
+            r[#r+1] = b
+        else
+            redis.call("SREM", DIRTY_SET, k)
+        end
+    end
+    if #r == 0 then return nil end
+    return r
+end
+
+-- 以租约方式领取指定的脏数据
+-- KEYS 待领取键值列表，不在队列中(不脏或已被领取)的忽略
+-- ARGV[1] 回写者标识
+-- ARGV[2] 租约时长(毫秒)
+-- RET nil无待回写数据 or {待回写键值1，待回写数据1，待回写键值2，待回写数据2...}
+local function redmon_sync_claim()
+    local now = redmon_now()
+    local r = {}
+    for _, k in ipairs(KEYS) do
+        if redis.call("LREM", DIRTY_QUE, 1, k) > 0 then
+            local b = redis.call("GET", k)
+            if b then
+                redis.call("ZADD", DIRTY_LEASE, now + tonumber(ARGV[2]), k)
+                redis.call("HSET", DIRTY_OWNER, k, ARGV[1])
+                r[#r+1] = k
+                r[#r+1] = b
+            else
+                redis.call("SREM", DIRTY_SET, k)
+            end
+        end
+    end
+    if #r == 0 then return nil end
+    return r
+end
+
+-- 领取者的邮件历史重新入队，保持原有顺序
+local function redmon_mb_history_release(owner)
+    local k = MAIL_HISTORY .. ":" .. owner
+    local r = redis.call("LRANGE", k, 0, -1)
+    if #r > 0 then redis.call("RPUSH", MAIL_HISTORY, unpack(r)) end
+    redis.call("DEL", k)
+    redis.call("ZREM", MAIL_HISTORY_LEASE, owner)
+end
+
+-- 以租约方式领取邮件历史，从队尾(最早的)开始
+-- ARGV[1] 领取者标识
+-- ARGV[2] 租约时长(毫秒)
+-- ARGV[3] 最多领取的数量
+-- RET 邮件历史列表，最早的在最后
+local function redmon_mb_history()
+    local now = redmon_now()
+    for _, owner in ipairs(redis.call("ZRANGEBYSCORE", MAIL_HISTORY_LEASE, "-inf", now, "LIMIT", 0, 100)) do
+        redmon_mb_history_release(owner)
+    end
+    local n = tonumber(ARGV[3])
+    local r = redis.call("LRANGE", MAIL_HISTORY, -n, -1)
+    if #r == 0 then return r end
+    redis.call("LTRIM", MAIL_HISTORY, 0, -n - 1)
+    redis.call("RPUSH", MAIL_HISTORY .. ":" .. ARGV[1], unpack(r))
+    redis.call("ZADD", MAIL_HISTORY_LEASE, now + tonumber(ARGV[2]), ARGV[1])
+    return r
+end
+
+-- 确认领取的邮件历史，租约已到期并重新入队的忽略
+-- ARGV[1] 领取者标识
+-- ARGV[2] "1"已写入，删除；否则重新入队
+-- RET 0
+local function redmon_mb_history_ack()
+    if ARGV[2] == "1" then
+        redis.call("DEL", MAIL_HISTORY .. ":" .. ARGV[1])
+        redis.call("ZREM", MAIL_HISTORY_LEASE, ARGV[1])
+    else
+        redmon_mb_history_release(ARGV[1])
+    end
+    return 0
+end
+
 local cmd = ARGV[1]
 table.remove(ARGV, 1)
 if cmd == "redmon_load" then
@@ -187,12 +766,43 @@ elseif cmd == "redmon_set" then
     return redmon_set()
 elseif cmd == "redmon_add" then
     return redmon_add()
+elseif cmd == "redmon_del" then
+    return redmon_del()
+elseif cmd == "redmon_incr" then
+    return redmon_incr()
+elseif cmd == "redmon_hget" then
+    return redmon_hget()
+elseif cmd == "redmon_hgetall" then
+    return redmon_hgetall()
+elseif cmd == "redmon_hset" then
+    return redmon_hset()
+elseif cmd == "redmon_hdel" then
+    return redmon_hdel()
 elseif cmd == "redmon_mb_push" then
     return redmon_mb_call(redmon_mb_push)
 elseif cmd == "redmon_mb_pull" then
     return redmon_mb_call(redmon_mb_pull)
+elseif cmd == "redmon_mb_pop" then
+    return redmon_mb_call(redmon_mb_pop)
+elseif cmd == "redmon_mb_materialize" then
+    for j = 2, #KEYS do
+        if redis.call("EXISTS", KEYS[j]) == 0 then return nil end
+    end
+    return redmon_mb_call(redmon_mb_materialize)
+elseif cmd == "redmon_mb_mark" then
+    return redmon_mb_call(redmon_mb_mark)
+elseif cmd == "redmon_mb_list" then
+    return redmon_mb_list()
+elseif cmd == "redmon_mb_history" then
+    return redmon_mb_history()
+elseif cmd == "redmon_mb_history_ack" then
+    return redmon_mb_history_ack()
 elseif cmd == "redmon_sync" then
     return redmon_sync()
+elseif cmd == "redmon_sync_lease" then
+    return redmon_sync_lease()
+elseif cmd == "redmon_sync_claim" then
+    return redmon_sync_claim()
 else
     error("redmon: bad command")
 end
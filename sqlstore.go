@@ -0,0 +1,167 @@
+package redmon
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQL存储，数据按KeyMappingFunc映射到(schema, table, id)
+// 使用$N占位符和INSERT ... ON CONFLICT，适用于PostgreSQL和SQLite
+// 哈希数据以msgpack整体写入val，hash列为其标记
+// 表结构(SQLite中val类型为BLOB):
+//
+//	CREATE TABLE schema.table (
+//		id   TEXT PRIMARY KEY,
+//		rev  BIGINT NOT NULL,
+//		val  BYTEA,
+//		del  BOOLEAN NOT NULL DEFAULT FALSE,
+//		hash BOOLEAN NOT NULL DEFAULT FALSE
+//	)
+//
+// 没有hash列的旧表需要先迁移，已有数据都不是哈希数据:
+//
+//	ALTER TABLE schema.table ADD COLUMN hash BOOLEAN NOT NULL DEFAULT FALSE
+type SQLStore struct {
+	db             *sql.DB
+	keyMappingFunc KeyMappingFunc
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// keyMap为nil时使用默认映射规则
+func NewSQLStore(db *sql.DB, keyMap KeyMappingFunc) *SQLStore {
+	return &SQLStore{db: db, keyMappingFunc: keyMap}
+}
+
+// quoted "schema"."table"
+func sqlTable(schema, table string) string {
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	return quote(schema) + "." + quote(table)
+}
+
+func (s *SQLStore) Load(ctx context.Context, key string) (res Result, err error) {
+	schema, table, id := s.keyMappingFunc.mapKey(key)
+	var (
+		b         []byte
+		del, hash bool
+	)
+	if err = s.db.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT rev, val, del, hash FROM %s WHERE id = $1`, sqlTable(schema, table)),
+		id).Scan(&res.Rev, &b, &del, &hash); err != nil {
+		if err == sql.ErrNoRows {
+			res.Err, err = ErrNotExists, nil
+		}
+		return
+	}
+	if del {
+		res.Err = ErrNotExists
+		return
+	}
+	res.Val, res.Hash = string(b), hash
+	return
+}
+
+// One query for each (schema, table) group
+func (s *SQLStore) LoadMany(ctx context.Context, keys []string) (a []Result, err error) {
+	type group struct {
+		schema, table string
+	}
+	groups := make(map[group]map[string][]int)
+	a = make([]Result, len(keys))
+	for i, key := range keys {
+		schema, table, id := s.keyMappingFunc.mapKey(key)
+		g := group{schema, table}
+		if groups[g] == nil {
+			groups[g] = make(map[string][]int)
+		}
+		groups[g][id] = append(groups[g][id], i)
+		a[i].Err = ErrNotExists
+	}
+	for g, m := range groups {
+		var (
+			marks = make([]string, 0, len(m))
+			args  = make([]any, 0, len(m))
+		)
+		for id := range m {
+			args = append(args, id)
+			marks = append(marks, fmt.Sprintf("$%d", len(args)))
+		}
+		rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+			`SELECT id, rev, val, del, hash FROM %s WHERE id IN (%s)`,
+			sqlTable(g.schema, g.table), strings.Join(marks, ",")), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				id, b     []byte
+				rev       int64
+				del, hash bool
+			)
+			if err = rows.Scan(&id, &rev, &b, &del, &hash); err != nil {
+				break
+			}
+			for _, i := range m[string(id)] {
+				if a[i].Rev = rev; !del {
+					a[i].Val, a[i].Err, a[i].Hash = string(b), nil, hash
+				}
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (s *SQLStore) Save(ctx context.Context, key string, rev int64, val string) error {
+	return s.save(ctx, Entry{Key: key, Rev: rev, Val: val})
+}
+
+// 软删除，保留墓碑修订
+func (s *SQLStore) Delete(ctx context.Context, key string, rev int64) error {
+	return s.save(ctx, Entry{Key: key, Rev: rev, Del: true})
+}
+
+// 逐个写入，单个数据失败不影响其他数据
+func (s *SQLStore) SaveMany(ctx context.Context, entries []Entry) []error {
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		errs[i] = s.save(ctx, e)
+	}
+	return errs
+}
+
+// 只有表中的修订小于待保存修订时才会写入，否则返回ErrStaleWrite
+// 哈希数据总是整体写入
+func (s *SQLStore) save(ctx context.Context, e Entry) error {
+	schema, table, id := s.keyMappingFunc.mapKey(e.Key)
+	var val []byte
+	if !e.Del {
+		val = []byte(e.Val)
+	}
+	r, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %[1]s AS t (id, rev, val, del, hash) VALUES ($1, $2, $3, $4, $5) `+
+			`ON CONFLICT (id) DO UPDATE SET rev = excluded.rev, val = excluded.val, del = excluded.del, `+
+			`hash = excluded.hash WHERE t.rev < excluded.rev`, sqlTable(schema, table)),
+		id, e.Rev, val, e.Del, e.Hash && !e.Del)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStaleWrite
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package redmon
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLStore(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal("failed to open sqlite:", err)
+	}
+	defer db.Close()
+	// in-memory database is per connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(context.Background(), `CREATE TABLE "main"."redmon" (
+		id   TEXT PRIMARY KEY,
+		rev  BIGINT NOT NULL,
+		val  BLOB,
+		del  BOOLEAN NOT NULL DEFAULT FALSE,
+		hash BOOLEAN NOT NULL DEFAULT FALSE
+	)`); err != nil {
+		t.Fatal("failed to create table:", err)
+	}
+	testStore(t, NewSQLStore(db, func(key string) (_, _, _ string) {
+		return "main", "redmon", key
+	}))
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal("failed to open sqlite:", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	// table without hash column
+	for _, stmt := range []string{
+		`CREATE TABLE "main"."redmon" (
+			id  TEXT PRIMARY KEY,
+			rev BIGINT NOT NULL,
+			val BLOB,
+			del BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`INSERT INTO "main"."redmon" (id, rev, val, del) VALUES ('hello', 1, 'world', FALSE)`,
+		`ALTER TABLE "main"."redmon" ADD COLUMN hash BOOLEAN NOT NULL DEFAULT FALSE`,
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal("failed to prepare table:", err)
+		}
+	}
+	s := NewSQLStore(db, func(key string) (_, _, _ string) {
+		return "main", "redmon", key
+	})
+	if a, err := s.LoadMany(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("unexpected load many err: %v", err)
+	} else if a[0].Err != nil || a[0].Rev != 1 || a[0].Val != "world" || a[0].Hash {
+		t.Fatalf("unexpected load many ret: %v", a)
+	}
+	if err := s.Save(ctx, "hello", 2, "again"); err != nil {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+}
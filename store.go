@@ -0,0 +1,57 @@
+package redmon
+
+import (
+	"context"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// 待保存数据
+type Entry struct {
+	Key string
+	Rev int64
+	Val string
+	// 删除墓碑，保存时只保留修订
+	Del bool
+	// 哈希数据标记，Val为字段到值的msgpack map，空哈希为空串
+	Hash bool
+	// 哈希数据自存储中的上一修订以来修改的字段，Val中没有的字段已被删除
+	// 非nil时存储可以只写入这些字段，nil时需要整体写入
+	Fields []string
+}
+
+// 持久化存储，缓存数据由Sync回写到存储，缓存未命中时从存储加载
+// 存储以修订保证写入顺序，删除的数据保留修订(墓碑)，防止过期的回写使数据复活
+type Store interface {
+	// 加载数据，数据不存在或已删除时Result.Err为ErrNotExists，同时返回其修订，
+	// 哈希数据需要设置Result.Hash，返回的error只表示存储访问失败
+	Load(ctx context.Context, key string) (Result, error)
+	// 批量加载数据，单键结果同Load
+	LoadMany(ctx context.Context, keys []string) ([]Result, error)
+	// 保存数据，只有存储中的修订小于rev时才写入，否则返回ErrStaleWrite
+	// 仅供直接使用，Client总是通过SaveMany回写
+	Save(ctx context.Context, key string, rev int64, val string) error
+	// 删除数据，保留rev修订的墓碑，修订规则同Save
+	// 仅供直接使用，Client总是通过SaveMany回写
+	Delete(ctx context.Context, key string, rev int64) error
+	// 批量保存或删除数据，返回每个数据的结果
+	SaveMany(ctx context.Context, entries []Entry) []error
+}
+
+// 解码哈希数据，空串为空哈希
+func decodeHash(val string) (h map[string]string, err error) {
+	h = make(map[string]string)
+	if len(val) > 0 {
+		err = msgpack.Unmarshal(s2b(val), &h)
+	}
+	return
+}
+
+// 编码哈希数据，与脚本一致，空哈希编码为空串
+func encodeHash(h map[string]string) (string, error) {
+	if len(h) == 0 {
+		return "", nil
+	}
+	b, err := msgpack.Marshal(h)
+	return b2s(b), err
+}
@@ -0,0 +1,105 @@
+package redmon
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func storeLoad(ctx context.Context, s Store, key string) (int64, string, error) {
+	res, err := s.Load(ctx, key)
+	if err != nil {
+		return 0, "", err
+	}
+	return res.Rev, res.Val, res.Err
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("test:redmon:%d", rand.Int())
+
+	if _, _, err := storeLoad(ctx, s, key); err != ErrNotExists {
+		t.Fatalf("unexpected load err: %v", err)
+	}
+	if err := s.Save(ctx, key, 2, "hello"); err != nil {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+	if rev, val, err := storeLoad(ctx, s, key); err != nil {
+		t.Fatalf("unexpected load err: %v", err)
+	} else if rev != 2 || val != "hello" {
+		t.Fatalf("unexpected load ret: %v, %v", rev, val)
+	}
+	// stale write is skipped
+	if err := s.Save(ctx, key, 1, "world"); err != ErrStaleWrite {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+	if err := s.Save(ctx, key, 2, "world"); err != ErrStaleWrite {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+	// tombstone keeps revision
+	if err := s.Delete(ctx, key, 3); err != nil {
+		t.Fatalf("unexpected delete err: %v", err)
+	}
+	if rev, _, err := storeLoad(ctx, s, key); err != ErrNotExists || rev != 3 {
+		t.Fatalf("unexpected load ret: %v, %v", rev, err)
+	}
+	if err := s.Save(ctx, key, 3, "world"); err != ErrStaleWrite {
+		t.Fatalf("unexpected save err: %v", err)
+	}
+	if a, err := s.LoadMany(ctx, []string{key, key + "x"}); err != nil {
+		t.Fatalf("unexpected load many err: %v", err)
+	} else if a[0].Rev != 3 || a[0].Err != ErrNotExists || a[1].Rev != 0 || a[1].Err != ErrNotExists {
+		t.Fatalf("unexpected load many ret: %v", a)
+	}
+	if errs := s.SaveMany(ctx, []Entry{
+		{Key: key, Rev: 4, Val: "hello"},
+		{Key: key + "x", Rev: 1, Val: "world"},
+	}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("unexpected save many errs: %v", errs)
+	}
+	if a, err := s.LoadMany(ctx, []string{key, key + "x"}); err != nil {
+		t.Fatalf("unexpected load many err: %v", err)
+	} else if a[0].Val != "hello" || a[1].Val != "world" {
+		t.Fatalf("unexpected load many ret: %v", a)
+	}
+
+	// hash, the second write only changes field b and c
+	for i, h := range []map[string]string{
+		{"a": "1", "b": "2"},
+		{"a": "1", "c": "3"},
+	} {
+		e := Entry{Key: key, Rev: int64(5 + i), Hash: true}
+		if i > 0 {
+			e.Fields = []string{"b", "c"}
+		}
+		e.Val, _ = encodeHash(h)
+		if errs := s.SaveMany(ctx, []Entry{e}); errs[0] != nil {
+			t.Fatalf("unexpected save many errs: %v", errs)
+		}
+		a, err := s.LoadMany(ctx, []string{key})
+		if err != nil {
+			t.Fatalf("unexpected load many err: %v", err)
+		} else if a[0].Err != nil || !a[0].Hash {
+			t.Fatalf("unexpected load many ret: %v", a)
+		}
+		if res, err := s.Load(ctx, key); err != nil {
+			t.Fatalf("unexpected load err: %v", err)
+		} else if res.Err != nil || !res.Hash || res.Val != a[0].Val {
+			t.Fatalf("unexpected load ret: %v", res)
+		}
+		if m, err := decodeHash(a[0].Val); err != nil {
+			t.Fatalf("unexpected decode err: %v", err)
+		} else if !reflect.DeepEqual(m, h) {
+			t.Fatalf("unexpected hash: %v", m)
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
@@ -0,0 +1,356 @@
+package redmon
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ntons/redis"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// 以批量方式回写且未指定租约时长时使用的默认租约时长
+const defaultSyncLease = time.Minute
+
+// Flush每次领取的脏数据数量
+const defaultFlushBatch = 100
+
+// Flush出错返回前释放租约的超时时长
+const defaultReleaseTimeout = time.Second
+
+// 待回写数据
+type xSyncItem struct {
+	key  string
+	data xRedisData
+}
+
+// 回写结果，ok为false表示回写失败
+type xSyncAck struct {
+	key string
+	rev int64
+	ok  bool
+}
+
+// 确认已回写的数据，然后领取待回写数据，没有待回写数据时返回redis.Nil
+type xSyncClaimFunc func(ctx context.Context, acks []xSyncAck) ([]xSyncItem, error)
+
+// 只确认已回写的数据，释放租约，成功时返回redis.Nil
+type xSyncReleaseFunc func(ctx context.Context, acks []xSyncAck) error
+
+// 回写脏数据到DB，直到ctx结束
+// 默认从队尾逐个回写，只能有一个回写者；指定WithLease时以租约方式领取脏数据，
+// 可以有多个回写者(包括多个进程)并行回写，两种方式不能混用
+// 指定WithBatch时每次领取多个脏数据，通过Store.SaveMany批量回写，
+// 未指定WithLease时自动以默认租约时长(1分钟)进入租约方式，同样不能与默认方式混用
+// 每批数据回写后按回调返回的最大时长等待一次，租约方式等待前先确认并释放租约
+func (cli *Client) Sync(ctx context.Context, opts ...SyncOption) {
+	var xopts xSyncOptions
+	for _, opt := range opts {
+		opt.apply(&xopts)
+	}
+	if xopts.batch > 1 && xopts.lease <= 0 {
+		xopts.lease = defaultSyncLease
+	}
+	if xopts.lease <= 0 {
+		cli.sync(ctx, cli.claim, nil, xopts.drain)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < xopts.workers || i == 0; i++ {
+		w := &xLeaseWorker{
+			cli:   cli,
+			id:    newWorkerId(),
+			lease: xopts.lease,
+			batch: xopts.batch,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cli.sync(ctx, w.claim, w.release, xopts.drain)
+		}()
+	}
+	wg.Wait()
+}
+
+// 回写所有脏数据和邮件历史直到队列为空，指定keys时只回写这些数据，用于停机前确保数据落地
+// 以租约方式领取脏数据，可以与租约方式的Sync同时运行
+// 返回回写成功的数量和回写失败的数据，失败的数据重新入队，
+// 指定的数据如果正被其他回写者回写则忽略
+// 出错返回时(包括ctx结束)释放持有的租约，已回写的数据确认，其他的重新入队
+func (cli *Client) Flush(ctx context.Context, keys ...string) (n int, failed map[string]error, err error) {
+	w := &xLeaseWorker{
+		cli:   cli,
+		id:    newWorkerId(),
+		lease: defaultSyncLease,
+		batch: defaultFlushBatch,
+	}
+	failed = make(map[string]error)
+	var acks, failedAcks []xSyncAck
+	defer func() {
+		if err == nil || len(acks)+len(failedAcks) == 0 {
+			return
+		}
+		// ctx可能已结束，使用独立的ctx
+		rctx, cancel := context.WithTimeout(context.Background(), defaultReleaseTimeout)
+		defer cancel()
+		w.claimN(rctx, append(acks, failedAcks...), 0)
+	}()
+	for claimed := false; ; claimed = true {
+		var items []xSyncItem
+		if len(keys) == 0 {
+			items, err = w.claim(ctx, acks)
+		} else if !claimed {
+			items, err = w.claimKeys(ctx, keys)
+		} else {
+			_, err = w.claimN(ctx, acks, 0)
+		}
+		if err != nil {
+			// 未释放的租约由defer释放
+			if err == redis.Nil {
+				acks = acks[:0]
+			}
+			break
+		}
+		acks = acks[:0]
+		errs := cli.saveMany(ctx, items)
+		for i, item := range items {
+			ack := xSyncAck{key: item.key, rev: item.data.Rev}
+			if errs[i] == nil || errs[i] == ErrStaleWrite {
+				ack.ok = true
+				acks = append(acks, ack)
+				n++
+			} else {
+				failedAcks = append(failedAcks, ack)
+				failed[item.key] = errs[i]
+			}
+		}
+	}
+	if err != redis.Nil {
+		return
+	}
+	// 失败的数据在队列排空后才重新入队，避免重复领取
+	if _, err = w.claimN(ctx, failedAcks, 0); err != redis.Nil {
+		return
+	}
+	failedAcks, err = nil, nil
+	// 未指定keys时同时回写所有邮件历史
+	for m := 1; len(keys) == 0 && m > 0 && err == nil; {
+		m, err = cli.syncHistory(ctx)
+	}
+	return
+}
+
+// drain为true时队列为空即返回，release为nil时等待前不释放
+func (cli *Client) sync(ctx context.Context, claim xSyncClaimFunc, release xSyncReleaseFunc, drain bool) {
+	var backoff *time.Timer
+	wait := func(d time.Duration) bool {
+		if d <= 0 {
+			return true
+		}
+		if backoff == nil {
+			backoff = time.NewTimer(d)
+		} else {
+			backoff.Reset(d)
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-backoff.C:
+			return true
+		}
+	}
+	defer func() {
+		if backoff != nil {
+			backoff.Stop()
+		}
+	}()
+	var acks []xSyncAck
+	for {
+		items, err := claim(ctx, acks)
+		acks = acks[:0]
+		// 邮件历史随脏数据回写，每轮一批
+		n, herr := cli.syncHistory(ctx)
+		if herr != nil && !wait(cli.onSyncFail(herr)) {
+			return
+		}
+		if err != nil {
+			var d time.Duration
+			if err == redis.Nil {
+				if n > 0 || herr != nil {
+					continue
+				}
+				if drain {
+					return
+				}
+				d = cli.onSyncIdle()
+			} else {
+				d = cli.onSyncFail(err)
+			}
+			if !wait(d) {
+				return
+			}
+			continue
+		}
+		errs := cli.saveMany(ctx, items)
+		var d time.Duration
+		for i, item := range items {
+			// DB中的数据更新时同样确认，不再重试
+			acks = append(acks, xSyncAck{
+				key: item.key,
+				rev: item.data.Rev,
+				ok:  errs[i] == nil || errs[i] == ErrStaleWrite,
+			})
+			var e time.Duration
+			if errs[i] == nil {
+				e = cli.onSyncSave(item.key)
+			} else if errs[i] == ErrStaleWrite {
+				e = cli.onSyncStale(item.key, item.data.Rev)
+			} else {
+				e = cli.onSyncFail(errs[i])
+			}
+			if e > d {
+				d = e
+			}
+		}
+		if d > 0 && release != nil {
+			// 释放失败时由下次领取确认
+			if err = release(ctx, acks); err == redis.Nil {
+				acks = acks[:0]
+			}
+		}
+		if !wait(d) {
+			return
+		}
+	}
+}
+
+// 逐个回写，回写失败时重新获取队尾
+func (cli *Client) claim(ctx context.Context, acks []xSyncAck) ([]xSyncItem, error) {
+	if len(acks) == 1 && acks[0].ok {
+		key, data, err := cli.next(ctx, acks[0].key, acks[0].rev)
+		return []xSyncItem{{key, data}}, err
+	}
+	key, data, err := cli.peek(ctx)
+	return []xSyncItem{{key, data}}, err
+}
+
+// peek top dirty key and data
+func (cli *Client) peek(ctx context.Context) (string, xRedisData, error) {
+	return getSyncRes1(luaScript.Run(ctx, cli.rdb, []string{}, "redmon_sync"))
+}
+
+// clean dirty flag and make key volatile, then peek the next
+func (cli *Client) next(ctx context.Context, key string, rev int64) (string, xRedisData, error) {
+	return getSyncRes1(luaScript.Run(ctx, cli.rdb, []string{key},
+		append([]any{"redmon_sync", rev}, cli.ttlArgs(key, 0)...)...))
+}
+
+// 租约回写者
+type xLeaseWorker struct {
+	cli   *Client
+	id    string
+	lease time.Duration
+	batch int
+}
+
+func newWorkerId() string {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// release leases of saved keys, failed keys are queued again, then claim
+// the next batch of dirty keys with lease
+// the saved key is ignored if lease has expired and been claimed by others
+func (w *xLeaseWorker) claim(ctx context.Context, acks []xSyncAck) ([]xSyncItem, error) {
+	n := w.batch
+	if n < 1 {
+		n = 1
+	}
+	return w.claimN(ctx, acks, n)
+}
+
+// release leases of saved keys only, failed keys are queued again
+func (w *xLeaseWorker) release(ctx context.Context, acks []xSyncAck) error {
+	_, err := w.claimN(ctx, acks, 0)
+	return err
+}
+
+// claim at most n dirty keys, only release if n is 0
+func (w *xLeaseWorker) claimN(ctx context.Context, acks []xSyncAck, n int) ([]xSyncItem, error) {
+	keys := make([]string, 0, len(acks))
+	args := make([]any, 0, 4+len(acks)*2)
+	args = append(args, "redmon_sync_lease", w.id, w.lease.Milliseconds(), n)
+	for _, ack := range acks {
+		keys = append(keys, ack.key)
+		var rev, ex any = "", ""
+		if ack.ok {
+			rev = ack.rev
+		}
+		if a := w.cli.ttlArgs(ack.key, 0); len(a) > 0 {
+			ex = a[0]
+		}
+		args = append(args, rev, ex)
+	}
+	return getSyncRes(luaScript.Run(ctx, w.cli.rdb, keys, args...))
+}
+
+// claim specified dirty keys with lease
+func (w *xLeaseWorker) claimKeys(ctx context.Context, keys []string) ([]xSyncItem, error) {
+	return getSyncRes(luaScript.Run(ctx, w.cli.rdb, keys,
+		"redmon_sync_claim", w.id, w.lease.Milliseconds()))
+}
+
+func getSyncRes(r *redis.Cmd) (items []xSyncItem, err error) {
+	var v interface{}
+	if v, err = r.Result(); err != nil {
+		return
+	}
+	a, ok := v.([]interface{})
+	if !ok || len(a) == 0 || len(a)%2 != 0 {
+		panic(fmt.Errorf("unexpected return type: %T", r))
+	}
+	for i := 0; i < len(a); i += 2 {
+		var data xRedisData
+		if err = msgpack.Unmarshal(s2b(a[i+1].(string)), &data); err != nil {
+			return
+		}
+		items = append(items, xSyncItem{a[i].(string), data})
+	}
+	return
+}
+
+func getSyncRes1(r *redis.Cmd) (key string, data xRedisData, err error) {
+	var items []xSyncItem
+	if items, err = getSyncRes(r); err != nil {
+		return
+	}
+	return items[0].key, items[0].data, nil
+}
+
+// 回写数据，返回每个数据的回写结果
+// 存储中已存在相同或更新修订的数据返回ErrStaleWrite
+func (cli *Client) saveMany(ctx context.Context, items []xSyncItem) []error {
+	entries := make([]Entry, 0, len(items))
+	for _, item := range items {
+		e := Entry{
+			Key:  item.key,
+			Rev:  item.data.Rev,
+			Val:  item.data.Val,
+			Del:  item.data.Del,
+			Hash: item.data.Hsh,
+		}
+		if e.Hash && !item.data.Hfull {
+			if e.Fields = item.data.Hch; e.Fields == nil {
+				e.Fields = []string{}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return cli.store.SaveMany(ctx, entries)
+}
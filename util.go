@@ -10,6 +10,16 @@ var (
 	ErrAlreadyExists = errors.New("redmon: already exists")
 	ErrNotExists     = errors.New("redmon: not exists")
 	ErrMailBoxFull   = errors.New("redmon: mail box full")
+	ErrRevMismatch   = errors.New("redmon: revision mismatch")
+	ErrNotNumber     = errors.New("redmon: not a number")
+	ErrOutOfRange    = errors.New("redmon: out of range")
+	ErrNotHash       = errors.New("redmon: not a hash")
+	// MSet的keys与vals长度不一致
+	ErrLengthMismatch = errors.New("redmon: keys and vals length mismatch")
+	// WithAfter只适用于默认的邮件ID格式
+	ErrBadCursor = errors.New("redmon: bad cursor")
+	// 存储中已存在相同或更新修订的数据，写入被跳过
+	ErrStaleWrite = errors.New("redmon: stale write")
 )
 
 // If you know for sure that the byte slice won't be mutated,